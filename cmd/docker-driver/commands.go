@@ -0,0 +1,134 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	dd "github.com/Datera/docker-driver/pkg/driver"
+)
+
+const commandUsage = `
+Commands:
+  volume set-readonly <name> <true|false>
+        Mark a volume read-only, applies the next time it is mounted
+  volume release <name> [--host <hostname|iqn>] [--force]
+        Remove other hosts from a volume's ACL so it can be mounted here.
+        Without --force only hosts with an expired lease are released
+  volume who-uses <name>
+        List the hosts and container mount IDs using a volume
+  volume restore <name>
+        Bring back a removed volume kept by soft_delete
+  volume orphans
+        List removed volumes whose delete failed and is being retried
+  volume gc [--dry-run]
+        Remove volumes unattached for longer than their ttl option, or
+        only list them with --dry-run
+`
+
+// runCommand runs a management command given on the command line instead of
+// starting the plugin server
+func runCommand(d *dd.DateraDriver, args []string) error {
+	if len(args) < 2 || args[0] != "volume" {
+		return fmt.Errorf("Unknown command: %v", args)
+	}
+	switch args[1] {
+	case "set-readonly":
+		if len(args) != 4 {
+			return fmt.Errorf("Usage: volume set-readonly <name> <true|false>")
+		}
+		ro, err := strconv.ParseBool(args[3])
+		if err != nil {
+			return fmt.Errorf("Invalid read-only value: %s", args[3])
+		}
+		if err = d.SetReadOnly(args[2], ro); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stdout, "Volume %s readOnly=%t\n", args[2], ro)
+		return nil
+	case "release":
+		fs := flag.NewFlagSet("release", flag.ContinueOnError)
+		h := fs.String("host", "", "Only release this host, by hostname or IQN")
+		force := fs.Bool("force", false, "Release hosts whose lease hasn't expired")
+		if len(args) < 3 || fs.Parse(args[3:]) != nil || fs.NArg() != 0 {
+			return fmt.Errorf("Usage: volume release <name> [--host <hostname|iqn>] [--force]")
+		}
+		released, err := d.Release(args[2], *h, *force)
+		if err != nil {
+			return err
+		}
+		if len(released) == 0 {
+			fmt.Fprintf(os.Stdout, "Volume %s is not attached to other hosts\n", args[2])
+			return nil
+		}
+		fmt.Fprintf(os.Stdout, "Volume %s released from %s\n", args[2], strings.Join(released, ", "))
+		return nil
+	case "who-uses":
+		if len(args) != 3 {
+			return fmt.Errorf("Usage: volume who-uses <name>")
+		}
+		users, err := d.WhoUses(args[2])
+		if err != nil {
+			return err
+		}
+		if len(users) == 0 {
+			fmt.Fprintf(os.Stdout, "Volume %s is not in use\n", args[2])
+			return nil
+		}
+		for _, u := range users {
+			fmt.Fprintf(os.Stdout, "%s\t%s\n", u.Host, strings.Join(u.MountIds, ","))
+		}
+		return nil
+	case "restore":
+		if len(args) != 3 {
+			return fmt.Errorf("Usage: volume restore <name>")
+		}
+		if err := d.Restore(args[2]); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stdout, "Volume %s restored\n", args[2])
+		return nil
+	case "orphans":
+		if len(args) != 2 {
+			return fmt.Errorf("Usage: volume orphans")
+		}
+		orphans, err := d.Orphans()
+		if err != nil {
+			return err
+		}
+		if len(orphans) == 0 {
+			fmt.Fprintln(os.Stdout, "No orphaned volumes")
+			return nil
+		}
+		for _, o := range orphans {
+			fmt.Fprintf(os.Stdout, "%s\tfailed %s\tattempts %d\t%s\n",
+				o.Name, o.FailedAt.Format(time.RFC3339), o.Attempts, o.LastError)
+		}
+		return nil
+	case "gc":
+		fs := flag.NewFlagSet("gc", flag.ContinueOnError)
+		dryRun := fs.Bool("dry-run", false, "Only list the volumes that would be removed")
+		if fs.Parse(args[2:]) != nil || fs.NArg() != 0 {
+			return fmt.Errorf("Usage: volume gc [--dry-run]")
+		}
+		found, err := d.CollectGarbage(*dryRun)
+		if err != nil {
+			return err
+		}
+		for _, c := range found {
+			state := "kept"
+			if *dryRun {
+				state = "would remove"
+			} else if c.Deleted {
+				state = "removed"
+			}
+			fmt.Fprintf(os.Stdout, "%s\tunattached %s\tttl %s\t%s\n",
+				c.Name, c.Idle.Round(time.Minute), c.Ttl, state)
+		}
+		return nil
+	}
+	return fmt.Errorf("Unknown volume command: %s", args[1])
+}
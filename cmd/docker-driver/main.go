@@ -40,12 +40,14 @@ Use -genconfig option to generate this file
 */
 
 var (
-	version = flag.Bool("version", false, "Print version info")
+	version      = flag.Bool("version", false, "Print version info")
+	driverConfig = flag.String("driver-config", dd.DefaultConfigFile, "Driver config file")
 )
 
 func Usage() {
-	fmt.Fprintf(os.Stderr, "Usage: %s [options]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "Usage: %s [options] [command]\n", os.Args[0])
 	flag.PrintDefaults()
+	fmt.Fprintf(os.Stderr, "%s", commandUsage)
 	msg := `
 A config file must either be specified via
 the '-config' opt or a '.datera-config-file'
@@ -74,7 +76,22 @@ func main() {
 	log.Info("Using Universal Datera Config")
 	udc.PrintConfig()
 
-	d := dd.NewDateraDriver(conf)
+	dconf, err := dd.LoadConfig(*driverConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+	co.Debugf(ctxt, "Using driver config: %s", co.Prettify(dconf))
+
+	d := dd.NewDateraDriver(conf, dconf)
+	if flag.NArg() > 0 {
+		if err = runCommand(&d, flag.Args()); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			fmt.Fprintf(os.Stderr, "%s", commandUsage)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	d.Start()
 	h := dv.NewHandler(&d)
 	u, err := user.Current()
 	if err != nil {
@@ -27,7 +27,7 @@ func PanicErr(err error) {
 func ExecC(ctxt context.Context, name string, arg ...string) *exec.Cmd {
 	cmd := name + " " + strings.Join(arg, " ")
 	Debugf(ctxt, "Executing Command: %s", cmd)
-	return exec.Command(name, arg...)
+	return exec.CommandContext(ctxt, name, arg...)
 }
 
 func Prettify(v interface{}) string {
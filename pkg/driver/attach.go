@@ -0,0 +1,237 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	co "github.com/Datera/docker-driver/pkg/common"
+)
+
+// attachOp is an attach (ACL, login, format and mount) of a volume running in
+// the background.  Docker gives up on a Mount call long before a large format
+// finishes, so repeated Mount calls for the same volume join the in-flight
+// attachOp instead of starting over.  A successful attachOp stays cached
+// until the last container using the volume on this host unmounts it
+type attachOp struct {
+	name   string
+	done   chan struct{}
+	err    error
+	cancel context.CancelFunc
+
+	// readOnly records whether the volume was attached read-only
+	readOnly bool
+
+	// users holds the mount IDs of the containers using the volume on this
+	// host.  It decides when the volume is detached, the copy kept in the
+	// volume's metadata is informational.  Guarded by d.Mutex
+	users map[string]bool
+}
+
+func (op *attachOp) finished() bool {
+	select {
+	case <-op.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// prepareAttach returns the attachOp for the volume, joining the one in
+// flight or cached if there is one and starting a new one otherwise.  An
+// attach made read-write isn't joined once the volume was set read-only
+func (d *DateraDriver) prepareAttach(ctxt context.Context, name string) (*attachOp, error) {
+	d.Mutex.Lock()
+	defer d.Mutex.Unlock()
+	vol, sv, err := d.lookup(ctxt, name)
+	if IsNotFound(err) {
+		return nil, fmt.Errorf("Volume not found: %s", d.MountPoint(name))
+	} else if err != nil {
+		return nil, err
+	}
+	if vol, err = d.backingVolume(ctxt, vol, sv); err != nil {
+		return nil, err
+	}
+	md, err := getMetadata(vol)
+	if err != nil {
+		return nil, err
+	}
+	ro := d.Config.ReadOnly || isReadOnly(md)
+	if op, err := d.joinAttach(ctxt, name, ro); op != nil || err != nil {
+		return op, err
+	}
+	// A volume can't be mounted directly and staged for subPath volumes
+	// on the same host at once
+	if sv == nil && d.isStaged(name) {
+		return nil, fmt.Errorf("Volume %s is mounted as the %s of subPath volumes on this host",
+			name, OptSubPathSrc)
+	}
+	if sv != nil {
+		if _, ok := d.attaches[sv.Source]; ok {
+			return nil, fmt.Errorf("Volume %s can't be mounted, its %s %s is mounted directly on this host",
+				name, OptSubPathSrc, sv.Source)
+		}
+	}
+	return d.startAttach(ctxt, name, sv, ro), nil
+}
+
+// joinAttach returns the attach of the volume in flight or cached, if any.
+// d.Mutex must be held
+func (d *DateraDriver) joinAttach(ctxt context.Context, name string, ro bool) (*attachOp, error) {
+	op, ok := d.attaches[name]
+	if !ok {
+		return nil, nil
+	}
+	if ro && !op.readOnly {
+		return nil, fmt.Errorf("Volume %s is set %s but attached read-write on this host, "+
+			"stop the containers using it here first", name, OptReadOnly)
+	}
+	co.Debugf(ctxt, "Joining existing attach of volume %s", name)
+	return op, nil
+}
+
+// startAttach starts the background attach of a volume, read-only if ro is
+// set.  d.Mutex must be held
+func (d *DateraDriver) startAttach(ctxt context.Context, name string, sv *subVolume, ro bool) *attachOp {
+	actxt, cancel := d.initFunc("Attach")
+	op := &attachOp{name: name, done: make(chan struct{}), cancel: cancel, readOnly: ro, users: map[string]bool{}}
+	d.attaches[name] = op
+	co.Debugf(ctxt, "Starting attach of volume %s, trace id %s", name, actxt.Value(co.TraceId))
+	go func() {
+		defer cancel()
+		if sv != nil {
+			op.err = d.attachSubVolume(actxt, sv)
+		} else {
+			op.err = doMount(actxt, d, name, d.MountPoint(name))
+		}
+		if op.err != nil {
+			co.Errorf(actxt, "Attach of volume %s failed: %s", name, op.err)
+		} else {
+			co.Debugf(actxt, "Attach of volume %s finished", name)
+			if t := d.Config.Timeouts.Unclaimed.Duration; t > 0 {
+				time.AfterFunc(t, func() { d.expireAttach(op) })
+			}
+		}
+		close(op.done)
+	}()
+	return op
+}
+
+// claimed reports whether a container uses the volume of op or a Mount may
+// still be waiting on it.  d.Mutex must be held
+func (op *attachOp) claimed() bool {
+	return !op.finished() || len(op.users) != 0
+}
+
+// unclaimed reports whether op is still the volume's attach and nothing
+// claimed it.  d.Mutex must be held
+func (d *DateraDriver) unclaimed(op *attachOp) bool {
+	return d.attaches[op.name] == op && !op.claimed()
+}
+
+// expireAttach detaches a volume whose attach finished but was never
+// claimed by a Mount, e.g. because Docker timed out waiting for it
+func (d *DateraDriver) expireAttach(op *attachOp) {
+	ctxt, cancel := d.initFunc("ExpireAttach")
+	defer cancel()
+	d.Mutex.Lock()
+	defer d.Mutex.Unlock()
+	if !d.unclaimed(op) {
+		return
+	}
+	co.Warningf(ctxt, "No Mount claimed the attach of volume %s within %s, detaching it",
+		op.name, d.Config.Timeouts.Unclaimed)
+	vol, sv, err := d.lookup(ctxt, op.name)
+	d.stopAttach(ctxt, op.name)
+	d.stopTrim(ctxt, op.name)
+	if IsNotFound(err) {
+		return
+	} else if err != nil {
+		co.Errorf(ctxt, "Could not detach unclaimed volume %s: %s", op.name, err)
+		return
+	}
+	if sv != nil {
+		d.stopTrim(ctxt, sv.Source)
+		err = d.detachSubVolume(ctxt, sv)
+	} else {
+		err = d.detach(ctxt, vol, d.MountPoint(op.name))
+	}
+	if err != nil {
+		co.Errorf(ctxt, "Could not detach unclaimed volume %s: %s", op.name, err)
+	}
+}
+
+// waitAttach waits for op to finish or the request's deadline to expire.
+// Failed attaches are dropped so the next Mount starts a fresh one
+func (d *DateraDriver) waitAttach(ctxt context.Context, op *attachOp) error {
+	select {
+	case <-op.done:
+	case <-ctxt.Done():
+		return &BackendError{
+			Kind: ErrTimeout,
+			Op:   "Mount",
+			Name: op.name,
+			Err:  fmt.Errorf("attach is still in progress, retry the Mount to wait for it"),
+		}
+	}
+	if op.err != nil {
+		d.Mutex.Lock()
+		if d.attaches[op.name] == op {
+			delete(d.attaches, op.name)
+		}
+		d.Mutex.Unlock()
+	}
+	return op.err
+}
+
+// stopAttach cancels any in-flight attach of the volume, waits for its
+// rollback to finish and drops the cached result.  d.Mutex must be held
+func (d *DateraDriver) stopAttach(ctxt context.Context, name string) {
+	op, ok := d.attaches[name]
+	if !ok {
+		return
+	}
+	if !op.finished() {
+		co.Infof(ctxt, "Cancelling in-flight attach of volume %s", name)
+		op.cancel()
+		<-op.done
+	}
+	delete(d.attaches, name)
+}
+
+// attachedVolume is a Datera volume attached to this host and where its
+// filesystem is mounted.  claimed is set when a container uses it or an
+// attach of it is in flight
+type attachedVolume struct {
+	name    string
+	mount   string
+	claimed bool
+}
+
+// attachedVolumes lists the Datera volumes attached to this host, including
+// attaches still in flight when pending is set.  Source volumes of subPath
+// volumes are listed once, at their staging directory
+func (d *DateraDriver) attachedVolumes(pending bool) []attachedVolume {
+	d.Mutex.Lock()
+	defer d.Mutex.Unlock()
+	seen := map[string]int{}
+	vols := []attachedVolume{}
+	for name, op := range d.attaches {
+		if op.finished() && op.err != nil || !pending && !op.finished() {
+			continue
+		}
+		a := attachedVolume{name: name, mount: d.MountPoint(name), claimed: op.claimed()}
+		d.subPaths.mutex.Lock()
+		if sv, ok := d.subPaths.known[name]; ok {
+			a.name, a.mount = sv.Source, d.StagingPath(sv.Source)
+		}
+		d.subPaths.mutex.Unlock()
+		if i, ok := seen[a.name]; ok {
+			vols[i].claimed = vols[i].claimed || a.claimed
+			continue
+		}
+		seen[a.name] = len(vols)
+		vols = append(vols, a)
+	}
+	return vols
+}
@@ -0,0 +1,158 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testOp builds an attachOp without running an attach.  Finished ops fail
+// with err
+func testOp(name string, finished bool, err error, ro bool) *attachOp {
+	op := &attachOp{name: name, done: make(chan struct{}), cancel: func() {}, readOnly: ro,
+		users: map[string]bool{}}
+	if finished {
+		op.err = err
+		close(op.done)
+	}
+	return op
+}
+
+func TestJoinAttach(t *testing.T) {
+	rw := testOp("rw", true, nil, false)
+	ro := testOp("ro", false, nil, true)
+	d := &DateraDriver{Mutex: &sync.Mutex{}, attaches: map[string]*attachOp{"rw": rw, "ro": ro}}
+	tests := []struct {
+		name    string
+		ro      bool
+		want    *attachOp
+		wantErr bool
+	}{
+		{"none", false, nil, false},
+		{"rw", false, rw, false},
+		{"rw", true, nil, true},
+		{"ro", false, ro, false},
+		{"ro", true, ro, false},
+	}
+	for _, tt := range tests {
+		op, err := d.joinAttach(testContext(), tt.name, tt.ro)
+		if op != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("joinAttach(%s, ro %t) = %v, %v, want %v, error %t", tt.name, tt.ro, op, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestUnclaimed(t *testing.T) {
+	pending := testOp("pending", false, nil, false)
+	idle := testOp("idle", true, nil, false)
+	used := testOp("used", true, nil, false)
+	used.users["mount1"] = true
+	replaced := testOp("idle", true, nil, false)
+	d := &DateraDriver{Mutex: &sync.Mutex{}, attaches: map[string]*attachOp{"pending": pending, "idle": idle, "used": used}}
+	tests := []struct {
+		name string
+		op   *attachOp
+		want bool
+	}{
+		{"in flight", pending, false},
+		{"never mounted", idle, true},
+		{"mounted", used, false},
+		{"replaced", replaced, false},
+	}
+	for _, tt := range tests {
+		if got := d.unclaimed(tt.op); got != tt.want {
+			t.Errorf("%s: unclaimed = %t, want %t", tt.name, got, tt.want)
+		}
+	}
+	delete(used.users, "mount1")
+	if !d.unclaimed(used) {
+		t.Errorf("unclaimed after the last unmount = false, want true")
+	}
+}
+
+func TestWaitAttach(t *testing.T) {
+	failed := errors.New("login failed")
+	ok := testOp("ok", true, nil, false)
+	bad := testOp("bad", true, failed, false)
+	slow := testOp("slow", false, nil, false)
+	d := &DateraDriver{Mutex: &sync.Mutex{}, attaches: map[string]*attachOp{"ok": ok, "bad": bad, "slow": slow}}
+	if err := d.waitAttach(testContext(), ok); err != nil {
+		t.Errorf("waitAttach(ok) = %v, want nil", err)
+	}
+	if err := d.waitAttach(testContext(), bad); err != failed {
+		t.Errorf("waitAttach(bad) = %v, want %v", err, failed)
+	}
+	ctxt, cancel := context.WithTimeout(testContext(), time.Millisecond)
+	defer cancel()
+	if err := d.waitAttach(ctxt, slow); !IsTimeout(err) {
+		t.Errorf("waitAttach(slow) = %v, want Timeout", err)
+	}
+	if _, found := d.attaches["bad"]; found {
+		t.Errorf("failed attach still cached")
+	}
+	if d.attaches["ok"] != ok || d.attaches["slow"] != slow {
+		t.Errorf("attaches = %v, want ok and slow kept", d.attaches)
+	}
+}
+
+func TestStopAttach(t *testing.T) {
+	ctxt, cancel := context.WithCancel(testContext())
+	op := &attachOp{name: "vol1", done: make(chan struct{}), cancel: cancel, users: map[string]bool{}}
+	rolledBack := false
+	go func() {
+		<-ctxt.Done()
+		rolledBack = true
+		close(op.done)
+	}()
+	d := &DateraDriver{Mutex: &sync.Mutex{}, attaches: map[string]*attachOp{"vol1": op}}
+	d.stopAttach(testContext(), "vol1")
+	if !rolledBack {
+		t.Errorf("stopAttach returned before the attach was rolled back")
+	}
+	if _, found := d.attaches["vol1"]; found {
+		t.Errorf("stopped attach still cached")
+	}
+	d.stopAttach(testContext(), "vol1")
+}
+
+func TestAttachedVolumes(t *testing.T) {
+	used := testOp("vol1", true, nil, false)
+	used.users["mount1"] = true
+	sub1 := testOp("sub1", true, nil, false)
+	sub2 := testOp("sub2", true, nil, false)
+	sub2.users["mount2"] = true
+	d := &DateraDriver{
+		Mutex: &sync.Mutex{},
+		attaches: map[string]*attachOp{
+			"vol1":    used,
+			"failed":  testOp("failed", true, errors.New("mount failed"), false),
+			"pending": testOp("pending", false, nil, false),
+			"sub1":    sub1,
+			"sub2":    sub2,
+		},
+		subPaths: newSubPaths(),
+	}
+	d.subPaths.known = map[string]subVolume{
+		"sub1": {Name: "sub1", Source: "src", Path: "a"},
+		"sub2": {Name: "sub2", Source: "src", Path: "b"},
+	}
+	byName := func(vols []attachedVolume) []attachedVolume {
+		sort.Slice(vols, func(i, j int) bool { return vols[i].name < vols[j].name })
+		return vols
+	}
+	want := []attachedVolume{
+		{"src", d.StagingPath("src"), true},
+		{"vol1", d.MountPoint("vol1"), true},
+	}
+	if got := byName(d.attachedVolumes(false)); !reflect.DeepEqual(got, want) {
+		t.Errorf("attachedVolumes(false) = %v, want %v", got, want)
+	}
+	want = append([]attachedVolume{{"pending", d.MountPoint("pending"), true}}, want...)
+	if got := byName(d.attachedVolumes(true)); !reflect.DeepEqual(got, want) {
+		t.Errorf("attachedVolumes(true) = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,71 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	co "github.com/Datera/docker-driver/pkg/common"
+)
+
+const (
+	// Access types, see OptAccessType
+	AccessFilesystem = "filesystem"
+	AccessBlock      = "block"
+
+	// Name of the device node exposed in the mountpoint of block volumes
+	BlockDeviceName = "device"
+)
+
+// BlockDevicePath returns where the device of a block volume is exposed
+// within its mountpoint
+func BlockDevicePath(mountpoint string) string {
+	return filepath.Join(mountpoint, BlockDeviceName)
+}
+
+// exposeBlock creates a block device node for dev inside mountpoint so the
+// raw LUN is available to containers that use the volume.  When ro is set
+// the device is marked read-only first
+func exposeBlock(ctxt context.Context, dev, mountpoint string, ro bool) error {
+	st := syscall.Stat_t{}
+	if err := syscall.Stat(dev, &st); err != nil {
+		return fmt.Errorf("Could not stat device %s: %s", dev, err)
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFBLK {
+		return fmt.Errorf("%s is not a block device", dev)
+	}
+	flag := "--setrw"
+	if ro {
+		flag = "--setro"
+	}
+	if _, err := run(ctxt, []string{"blockdev", flag, dev}); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(mountpoint, 0755); err != nil {
+		return err
+	}
+	node := BlockDevicePath(mountpoint)
+	if err := os.Remove(node); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	co.Debugf(ctxt, "Exposing device %s at %s", dev, node)
+	if err := syscall.Mknod(node, syscall.S_IFBLK|0660, int(st.Rdev)); err != nil {
+		return fmt.Errorf("Could not create device node %s: %s", node, err)
+	}
+	return nil
+}
+
+// removeBlock removes the device node and mountpoint created by exposeBlock
+func removeBlock(ctxt context.Context, mountpoint string) error {
+	node := BlockDevicePath(mountpoint)
+	co.Debugf(ctxt, "Removing device node %s", node)
+	if err := os.Remove(node); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Remove(mountpoint); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,282 @@
+package driver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+const (
+	DefaultConfigFile = "/etc/datera/docker-driver.json"
+
+	// Existing volume policies, see Config.ExistingVolumePolicy
+	ExistingIgnore = "ignore"
+	ExistingVerify = "verify"
+	ExistingUpdate = "update"
+)
+
+// Config holds settings for the driver itself.  Backend connection details
+// still come from the Universal Datera Config, this file only tunes driver
+// behavior and every field has a usable default
+type Config struct {
+	// ExistingVolumePolicy decides what Create does when the volume already
+	// exists.  "ignore" succeeds without looking at the options, "verify"
+	// fails if any requested option differs from the volume and "update"
+	// applies safe changes (growing, QoS) and fails on the rest
+	ExistingVolumePolicy string `json:"existing_volume_policy"`
+
+	// Retry is applied to idempotent backend calls that fail with a
+	// transient error or timeout
+	Retry RetryPolicy `json:"retry"`
+
+	// Timeouts are the deadlines applied to each Docker volume API call.
+	// They should stay below the plugin call timeout used by Docker
+	Timeouts Timeouts `json:"timeouts"`
+
+	// AllowedMkfsOpts lists the mkfs flags that may be given with the
+	// mkfsOpts volume option
+	AllowedMkfsOpts []string `json:"allowed_mkfs_opts"`
+
+	// AllowedMountOpts lists the mount options (without any "=value") that
+	// may be given with the mountOpts volume option
+	AllowedMountOpts []string `json:"allowed_mount_opts"`
+
+	// ReadOnly mounts every volume on this host read-only regardless of
+	// the readOnly volume option
+	ReadOnly bool `json:"read_only"`
+
+	// KeyDir holds the LUKS passphrases of encrypted volumes, one file per
+	// volume named <volume>.key
+	KeyDir string `json:"key_dir"`
+
+	// KeyCommand, if set, is run with the volume name appended as its last
+	// argument and must print the volume's LUKS passphrase on stdout.  It
+	// takes precedence over KeyDir
+	KeyCommand []string `json:"key_command"`
+
+	// Trim runs fstrim on mounted volumes in the background
+	Trim TrimConfig `json:"trim"`
+
+	// Fencing refuses to mount a volume while another host's initiator is
+	// in its ACL or logged in to it
+	Fencing bool `json:"fencing"`
+
+	// Lease is held by this host on every volume it has mounted so other
+	// hosts can tell when it has died and take its volumes over
+	Lease LeaseConfig `json:"lease"`
+
+	// AutoRelease lets Mount take a volume over from a host holding a live
+	// lease when FenceCommand confirms that host is down
+	AutoRelease bool `json:"auto_release"`
+
+	// FenceCommand is run with a host's initiator IQN and hostname (when
+	// known) appended and must exit 0 only if that host is down or fenced
+	FenceCommand []string `json:"fence_command"`
+
+	// ForceRemove lets Remove delete volumes that are still mounted by
+	// containers or attached to any host
+	ForceRemove bool `json:"force_remove"`
+
+	// SoftDelete keeps removed volumes so they can be restored
+	SoftDelete SoftDeleteConfig `json:"soft_delete"`
+
+	// DeleteFailures decides what Remove does when the backend fails to
+	// delete a volume.  "return" fails the Remove, "queue" succeeds and
+	// records the volume in OrphanFile to retry the delete every
+	// OrphanRetry
+	DeleteFailures string   `json:"delete_failures"`
+	OrphanFile     string   `json:"orphan_file"`
+	OrphanRetry    Duration `json:"orphan_retry"`
+
+	// GC removes volumes left unattached for longer than their ttl option
+	GC GCConfig `json:"gc"`
+}
+
+// Timeouts holds the deadline for each type of driver operation.  A zero
+// value disables the deadline for that operation
+type Timeouts struct {
+	Create  Duration `json:"create"`
+	Remove  Duration `json:"remove"`
+	Mount   Duration `json:"mount"`
+	Unmount Duration `json:"unmount"`
+	Get     Duration `json:"get"`
+	List    Duration `json:"list"`
+
+	// Attach bounds the background attach started by Mount, which may take
+	// several Mount calls to finish when a large volume is formatted
+	Attach Duration `json:"attach"`
+
+	// Unclaimed is how long a finished attach is kept for a Mount to claim
+	// it.  Docker never unmounts a Mount it gave up on, so an attach no
+	// Mount waits for is detached after this.  Zero keeps it forever
+	Unclaimed Duration `json:"unclaimed"`
+}
+
+// For returns the deadline for the named driver operation
+func (t Timeouts) For(reqName string) time.Duration {
+	switch reqName {
+	case "Create":
+		return t.Create.Duration
+	case "Remove":
+		return t.Remove.Duration
+	case "Mount":
+		return t.Mount.Duration
+	case "Unmount":
+		return t.Unmount.Duration
+	case "Get":
+		return t.Get.Duration
+	case "List":
+		return t.List.Duration
+	case "Attach":
+		return t.Attach.Duration
+	}
+	return 0
+}
+
+// Duration is a time.Duration that is written as a string such as "1m30s"
+// in the config file
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		ExistingVolumePolicy: ExistingVerify,
+		Retry: RetryPolicy{
+			MaxAttempts:    5,
+			InitialBackoff: Duration{500 * time.Millisecond},
+			MaxBackoff:     Duration{10 * time.Second},
+			Jitter:         0.2,
+			Deadline:       Duration{45 * time.Second},
+		},
+		Timeouts: Timeouts{
+			Create:    Duration{90 * time.Second},
+			Remove:    Duration{90 * time.Second},
+			Mount:     Duration{110 * time.Second},
+			Unmount:   Duration{90 * time.Second},
+			Get:       Duration{30 * time.Second},
+			List:      Duration{30 * time.Second},
+			Attach:    Duration{30 * time.Minute},
+			Unclaimed: Duration{10 * time.Minute},
+		},
+		KeyDir:         "/etc/datera/keys",
+		Fencing:        true,
+		DeleteFailures: DeleteQueue,
+		OrphanFile:     "/etc/datera/orphans.json",
+		OrphanRetry:    Duration{5 * time.Minute},
+		GC: GCConfig{
+			MaxPerRun: 10,
+		},
+		SoftDelete: SoftDeleteConfig{
+			ReapInterval: Duration{time.Hour},
+		},
+		Lease: LeaseConfig{
+			Duration: Duration{time.Minute},
+			Grace:    Duration{2 * time.Minute},
+		},
+		Trim: TrimConfig{
+			Jitter:      0.1,
+			Concurrency: 2,
+		},
+		AllowedMkfsOpts: []string{
+			"-b", "-d", "-E", "-i", "-I", "-J", "-K", "-l", "-L", "-m", "-n",
+			"-N", "-O", "-s", "-T",
+		},
+		AllowedMountOpts: []string{
+			"noatime", "nodiratime", "relatime", "discard", "nodiscard",
+			"barrier", "nobarrier", "data", "commit", "stripe", "inode64",
+			"logbufs", "logbsize", "largeio", "allocsize", "noquota",
+			"usrquota", "grpquota", "prjquota", "compress", "ssd",
+			"space_cache",
+		},
+	}
+}
+
+// LoadConfig reads the driver config file at path.  A missing file is not an
+// error, the defaults are returned instead
+func LoadConfig(path string) (*Config, error) {
+	conf := DefaultConfig()
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return conf, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(b, conf); err != nil {
+		return nil, fmt.Errorf("Invalid driver config %s: %s", path, err)
+	}
+	if err = conf.validate(); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+func (c *Config) validate() error {
+	switch c.ExistingVolumePolicy {
+	case ExistingIgnore, ExistingVerify, ExistingUpdate:
+	default:
+		return fmt.Errorf("Invalid existing_volume_policy: %s", c.ExistingVolumePolicy)
+	}
+	if c.Retry.MaxAttempts < 1 {
+		return fmt.Errorf("retry.max_attempts must be at least 1")
+	}
+	if c.Retry.Jitter < 0 || c.Retry.Jitter > 1 {
+		return fmt.Errorf("retry.jitter must be between 0 and 1")
+	}
+	if c.Lease.Duration.Duration < 0 || c.Lease.Grace.Duration < 0 {
+		return fmt.Errorf("lease.duration and lease.grace can't be negative")
+	}
+	if c.AutoRelease && len(c.FenceCommand) == 0 {
+		return fmt.Errorf("auto_release requires fence_command")
+	}
+	switch c.DeleteFailures {
+	case DeleteReturn:
+	case DeleteQueue:
+		if c.OrphanFile == "" || c.OrphanRetry.Duration <= 0 {
+			return fmt.Errorf("delete_failures %s requires orphan_file and a positive orphan_retry", DeleteQueue)
+		}
+	default:
+		return fmt.Errorf("Invalid delete_failures: %s", c.DeleteFailures)
+	}
+	if c.GC.Interval.Duration < 0 {
+		return fmt.Errorf("gc.interval can't be negative")
+	}
+	if c.GC.Interval.Duration > 0 && c.GC.MaxPerRun < 1 {
+		return fmt.Errorf("gc.max_per_run must be at least 1")
+	}
+	if c.SoftDelete.Retention.Duration < 0 {
+		return fmt.Errorf("soft_delete.retention can't be negative")
+	}
+	if c.SoftDelete.Retention.Duration > 0 && c.SoftDelete.ReapInterval.Duration <= 0 {
+		return fmt.Errorf("soft_delete.reap_interval must be positive")
+	}
+	if c.Trim.Interval.Duration < 0 {
+		return fmt.Errorf("trim.interval can't be negative")
+	}
+	if c.Trim.Jitter < 0 || c.Trim.Jitter > 1 {
+		return fmt.Errorf("trim.jitter must be between 0 and 1")
+	}
+	if c.Trim.Interval.Duration > 0 && c.Trim.Concurrency < 1 {
+		return fmt.Errorf("trim.concurrency must be at least 1")
+	}
+	return nil
+}
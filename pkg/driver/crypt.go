@@ -0,0 +1,135 @@
+package driver
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	co "github.com/Datera/docker-driver/pkg/common"
+)
+
+// cryptName returns the device mapper name used for an encrypted volume
+func cryptName(name string) string {
+	return "datera-" + name
+}
+
+// CryptDevicePath returns the dm-crypt device of an opened encrypted volume
+func CryptDevicePath(name string) string {
+	return filepath.Join("/dev/mapper", cryptName(name))
+}
+
+// volumeKey returns the LUKS passphrase of a volume.  KeyCommand takes
+// precedence over KeyDir when both are configured
+func (d *DateraDriver) volumeKey(ctxt context.Context, name string) ([]byte, error) {
+	if len(d.Config.KeyCommand) != 0 {
+		args := append(append([]string{}, d.Config.KeyCommand[1:]...), name)
+		cmd := co.ExecC(ctxt, d.Config.KeyCommand[0], args...)
+		stderr := &bytes.Buffer{}
+		cmd.Stderr = stderr
+		key, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("Key command failed for volume %s: %s: %s",
+				name, err, strings.TrimSpace(stderr.String()))
+		}
+		return trimKey(name, "Key command", key)
+	}
+	if d.Config.KeyDir == "" {
+		return nil, fmt.Errorf("No key_dir or key_command configured for encrypted volume %s", name)
+	}
+	path := filepath.Join(d.Config.KeyDir, name+".key")
+	key, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read key for volume %s: %s", name, err)
+	}
+	return trimKey(name, path, key)
+}
+
+// trimKey strips trailing newlines from a key so the same passphrase is
+// used whether it was printed by a command or written to a file with echo
+func trimKey(name, source string, key []byte) ([]byte, error) {
+	key = bytes.TrimRight(key, "\r\n")
+	if len(key) == 0 {
+		return nil, fmt.Errorf("%s gave an empty key for volume %s", source, name)
+	}
+	return key, nil
+}
+
+// cryptsetup runs cryptsetup with the key passed on stdin
+func cryptsetup(ctxt context.Context, key []byte, args ...string) error {
+	cmd := co.ExecC(ctxt, "cryptsetup", args...)
+	cmd.Stdin = bytes.NewReader(key)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("cryptsetup %s failed: %s: %s", args[0], err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// isLuks reports whether dev has a LUKS header
+func isLuks(ctxt context.Context, dev string) (bool, error) {
+	err := co.ExecC(ctxt, "cryptsetup", "isLuks", dev).Run()
+	if eerr, ok := err.(*exec.ExitError); ok && eerr.ExitCode() == 1 {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("Could not check %s for a LUKS header: %s", dev, err)
+	}
+	return true, nil
+}
+
+// openCrypt opens the LUKS mapping of an encrypted volume, formatting a blank
+// device with LUKS on first attach, and returns the mapped device
+func (d *DateraDriver) openCrypt(ctxt context.Context, name, dev string, ro bool) (string, error) {
+	mapped := CryptDevicePath(name)
+	if _, err := os.Stat(mapped); err == nil {
+		co.Debugf(ctxt, "Encrypted volume %s is already open at %s", name, mapped)
+		return mapped, nil
+	}
+	key, err := d.volumeKey(ctxt, name)
+	if err != nil {
+		return "", err
+	}
+	luks, err := isLuks(ctxt, dev)
+	if err != nil {
+		return "", err
+	}
+	if !luks {
+		found, err := probeFS(ctxt, dev)
+		if err != nil {
+			return "", err
+		}
+		if found != "" {
+			return "", fmt.Errorf("Refusing to encrypt volume %s, device %s already has a %s signature",
+				name, dev, found)
+		}
+		if ro {
+			return "", fmt.Errorf("Volume %s is read-only and has not been encrypted yet", name)
+		}
+		co.Infof(ctxt, "Formatting volume %s device %s with LUKS", name, dev)
+		if err = cryptsetup(ctxt, key, "luksFormat", "--batch-mode", "--key-file", "-", dev); err != nil {
+			return "", err
+		}
+	}
+	args := []string{"luksOpen", "--key-file", "-"}
+	if ro {
+		args = append(args, "--readonly")
+	}
+	args = append(args, dev, cryptName(name))
+	if err = cryptsetup(ctxt, key, args...); err != nil {
+		return "", err
+	}
+	return mapped, nil
+}
+
+// closeCrypt closes the LUKS mapping of an encrypted volume if it is open
+func closeCrypt(ctxt context.Context, name string) error {
+	if _, err := os.Stat(CryptDevicePath(name)); os.IsNotExist(err) {
+		return nil
+	}
+	_, err := run(ctxt, []string{"cryptsetup", "luksClose", cryptName(name)})
+	return err
+}
@@ -0,0 +1,50 @@
+package driver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVolumeKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for name, content := range map[string]string{
+		"plain":   "secret",
+		"newline": "secret\n",
+		"crlf":    "secret\r\n",
+		"empty":   "\n",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name+".key"), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fromDir := &DateraDriver{Config: &Config{KeyDir: dir}}
+	fromCmd := &DateraDriver{Config: &Config{KeyDir: dir, KeyCommand: []string{"echo"}}}
+	tests := []struct {
+		name    string
+		d       *DateraDriver
+		vol     string
+		want    string
+		wantErr bool
+	}{
+		{"file", fromDir, "plain", "secret", false},
+		{"file newline", fromDir, "newline", "secret", false},
+		{"file crlf", fromDir, "crlf", "secret", false},
+		{"file empty", fromDir, "empty", "", true},
+		{"file missing", fromDir, "missing", "", true},
+		// echo prints the volume name it is given followed by a newline
+		{"command newline", fromCmd, "secret", "secret", false},
+		{"no source", &DateraDriver{Config: &Config{}}, "plain", "", true},
+	}
+	for _, tt := range tests {
+		key, err := tt.d.volumeKey(testContext(), tt.vol)
+		if string(key) != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("%s: volumeKey(%s) = %q, %v, want %q, error %t", tt.name, tt.vol, key, err, tt.want, tt.wantErr)
+		}
+	}
+}
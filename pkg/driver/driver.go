@@ -6,8 +6,8 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
-	"strings"
 	"sync"
+	"time"
 
 	dv "github.com/docker/go-plugins-helpers/volume"
 
@@ -67,6 +67,23 @@ const (
 	OptPlacement   = "placementMode"
 	OptPersistence = "persistenceMode"
 	OptCloneSrc    = "cloneSrc"
+	OptFormatPol   = "formatPolicy"
+	OptFormatConf  = "formatConfirm"
+	OptMkfsOpts    = "mkfsOpts"
+	OptMountOpts   = "mountOpts"
+	OptAccessType  = "accessType"
+	OptReadOnly    = "readOnly"
+	OptEncrypted   = "encrypted"
+	OptUid         = "uid"
+	OptGid         = "gid"
+	OptMode        = "mode"
+	OptOwnerMount  = "ownerOnMount"
+	OptSubPath     = "subPath"
+	OptSubPathSrc  = "subPathSrc"
+	OptFsckPolicy  = "fsckPolicy"
+	OptTrim        = "trim"
+	OptForceAttach = "forceAttach"
+	OptTtl         = "ttl"
 
 	// V2 Volume Plugin static mounts must be under /mnt
 	MountLoc = "/mnt"
@@ -86,6 +103,23 @@ var (
 		OptPlacement:   []string{"Volume Placement", DefaultPlacement},
 		OptPersistence: []string{"Volume Persistence", DefaultPersistence},
 		OptCloneSrc:    []string{"Volume Source For Clone", "None"},
+		OptFormatPol:   []string{"Volume Format Policy (never, ifBlank, force)", FormatIfBlank},
+		OptFormatConf:  []string{"Volume Name, Required To Confirm formatPolicy=force", "None"},
+		OptMkfsOpts:    []string{"Space Separated mkfs Arguments", "None"},
+		OptMountOpts:   []string{"Comma Separated Mount Options", "None"},
+		OptAccessType:  []string{"Volume Access Type (filesystem, block)", AccessFilesystem},
+		OptReadOnly:    []string{"Volume Is Mounted Read-Only", "false"},
+		OptEncrypted:   []string{"Volume Is Encrypted On The Host With LUKS", "false"},
+		OptUid:         []string{"Owner UID Of The Filesystem Root", "None"},
+		OptGid:         []string{"Owner GID Of The Filesystem Root", "None"},
+		OptMode:        []string{"Octal Mode Of The Filesystem Root", "None"},
+		OptOwnerMount:  []string{"Reapply uid, gid and mode On Every Mount", "false"},
+		OptSubPath:     []string{"Subdirectory Of subPathSrc To Use As The Volume", "None"},
+		OptSubPathSrc:  []string{"Volume Holding The subPath", "None"},
+		OptFsckPolicy:  []string{"Check After Unclean Unmount (never, check, repair)", FsckRepair},
+		OptTrim:        []string{"Trim Periodically When Trimming Is Enabled On The Host", "true"},
+		OptForceAttach: []string{"Take The Volume Over From Other Hosts On The Next Mount", "false"},
+		OptTtl:         []string{"Remove The Volume After Being Unattached This Long", "None"},
 	}
 	topctxt = context.WithValue(context.Background(), "host", host)
 	host, _ = os.Hostname()
@@ -93,17 +127,27 @@ var (
 
 type DateraDriver struct {
 	DateraClient *dc.DateraClient
+	Config       *Config
 	Mutex        *sync.Mutex
+	attaches     map[string]*attachOp
+	subPaths     *subPaths
+	trims        *trimmer
+	orphans      *orphanQueue
 	Version      string
 	Debug        bool
 	Ssl          bool
 }
 
-func NewDateraDriver(conf *udc.UDC) DateraDriver {
+func NewDateraDriver(conf *udc.UDC, dconf *Config) DateraDriver {
 	d := DateraDriver{
-		Mutex:   &sync.Mutex{},
-		Version: DriverVersion,
-		Debug:   true,
+		Config:   dconf,
+		Mutex:    &sync.Mutex{},
+		attaches: map[string]*attachOp{},
+		subPaths: newSubPaths(),
+		trims:    newTrimmer(),
+		orphans:  newOrphanQueue(dconf.OrphanFile),
+		Version:  DriverVersion,
+		Debug:    true,
 	}
 	v := fmt.Sprintf("docker-driver-%s-%s-gosdk-%s", DriverVersion, Githash, SdkVersion)
 	client, err := dc.NewDateraClient(conf, true, v)
@@ -111,13 +155,42 @@ func NewDateraDriver(conf *udc.UDC) DateraDriver {
 		panic(err)
 	}
 	d.DateraClient = client
-	ctxt := d.initFunc("NewDateraDriver")
+	ctxt, cancel := d.initFunc("NewDateraDriver")
+	defer cancel()
 	co.Debugf(ctxt, "Creating DateraClient object with restAddress: %s", conf.MgmtIp)
 	co.Debugf(ctxt, "DateraDriver: %#v", d)
 	co.Debugf(ctxt, "Driver Version: %s", d.Version)
 	return d
 }
 
+// Start launches the driver's background workers.  It is only called when
+// serving the Docker volume API, not for management commands
+func (d *DateraDriver) Start() {
+	ctxt, cancel := d.initFunc("Start")
+	defer cancel()
+	if d.Config.Trim.Interval.Duration > 0 {
+		co.Infof(ctxt, "Trimming mounted volumes every %s", d.Config.Trim.Interval)
+		go d.runTrimmer(topctxt)
+	}
+	if d.Config.Lease.Duration.Duration > 0 {
+		co.Infof(ctxt, "Renewing leases on attached volumes every %s", d.Config.Lease.Duration.Duration/3)
+		go d.runHeartbeat(topctxt)
+	}
+	if d.Config.SoftDelete.Retention.Duration > 0 {
+		co.Infof(ctxt, "Keeping removed volumes for %s", d.Config.SoftDelete.Retention)
+		go d.runReaper(topctxt)
+	}
+	if d.Config.GC.Interval.Duration > 0 {
+		co.Infof(ctxt, "Collecting volumes past their %s every %s, dry run: %t",
+			OptTtl, d.Config.GC.Interval, d.Config.GC.DryRun)
+		go d.runGC(topctxt)
+	}
+	if d.Config.DeleteFailures == DeleteQueue {
+		co.Infof(ctxt, "Retrying failed deletes from %s every %s", d.Config.OrphanFile, d.Config.OrphanRetry)
+		go d.runOrphanRetry(topctxt)
+	}
+}
+
 // Create creates a volume on the configured Datera backend
 //
 // Specified using `--opt key=value` in the docker volume create command
@@ -126,14 +199,33 @@ func NewDateraDriver(conf *udc.UDC) DateraDriver {
 //	size
 //	replica -- Default: 3
 //  template
-//  fsType -- Default: ext4
+//  fsType -- Default: ext4, also supports xfs and btrfs
 //  maxIops
 //  maxBW
 //  placementMode -- Default: hybrid
 //  persistenceMode -- Default: manual
 //  cloneSrc
-func (d *DateraDriver) Create(r *dv.CreateRequest) error {
-	ctxt := d.initFunc("Create")
+//  formatPolicy -- Default: ifBlank
+//  formatConfirm -- Must equal the volume name when formatPolicy is force
+//  mkfsOpts
+//  mountOpts
+//  accessType -- Default: filesystem, block exposes the raw device
+//  readOnly -- Default: false
+//  encrypted -- Default: false
+//  uid
+//  gid
+//  mode
+//  ownerOnMount -- Default: false
+//  subPath -- Requires subPathSrc, maps the volume onto a subdirectory of it
+//  subPathSrc
+//  fsckPolicy -- Default: repair, checks the filesystem after an unclean unmount
+//  trim -- Default: true, false skips the volume in background fstrim passes
+//  forceAttach -- Default: false, true detaches other hosts on the next Mount
+//  ttl -- Removes the volume once unattached this long when collection is on
+func (d *DateraDriver) Create(r *dv.CreateRequest) (err error) {
+	ctxt, cancel := d.initFunc("Create")
+	defer cancel()
+	defer func() { err = timedOut(ctxt, r.Name, err) }()
 	co.Debugf(ctxt, "DateraDriver.Create: %#v", r)
 	co.Debugf(ctxt, "Creating volume %s\n", r.Name)
 	d.Mutex.Lock()
@@ -142,57 +234,89 @@ func (d *DateraDriver) Create(r *dv.CreateRequest) error {
 	co.Debugf(ctxt, "Mountpoint for Request %s is %s", r.Name, m)
 	volOpts := r.Options
 	co.Debugf(ctxt, "Volume Options: %#v", volOpts)
+	if err = validateVolOpts(r.Name, volOpts, d.Config); err != nil {
+		co.Errorf(ctxt, "Failed Create: %s", err)
+		return err
+	}
+
+	if _, ok := volOpts[OptSubPath]; ok {
+		if _, err = d.getVolume(ctxt, r.Name, false, false); err == nil {
+			return fmt.Errorf("Volume %s already exists and is not a subPath volume", r.Name)
+		} else if !IsNotFound(err) {
+			return err
+		}
+		return d.createSubVolume(ctxt, r.Name, volOpts)
+	}
 
 	co.Debugf(ctxt, "Checking for existing volume: %s", r.Name)
-	_, err := d.DateraClient.GetVolume(r.Name, true, true)
+	vol, err := d.getVolume(ctxt, r.Name, true, true)
 	if err == nil {
 		co.Debugf(ctxt, "Found already created volume: %s", r.Name)
-		return nil
+		if err = d.checkNotDeleted(vol); err != nil {
+			return err
+		}
+		if d.orphans.has(ctxt, r.Name) {
+			return fmt.Errorf("Volume %s was removed and is queued for deletion, use another name", r.Name)
+		}
+		if err = repairCreate(ctxt, vol, volOpts); err != nil {
+			return err
+		}
+		return d.checkExisting(ctxt, vol, volOpts)
 	}
-	// Quick hack to check if api didn't find a volume
-	if err != nil && !strings.Contains(err.Error(), "not exist") {
+	if !IsNotFound(err) {
 		return err
 	}
 	co.Debugf(ctxt, "Creating Volume: %s", r.Name)
 
-	size, _ := strconv.ParseUint(volOpts[OptSize], 10, 64)
-	replica, _ := strconv.ParseUint(volOpts[OptReplica], 10, 8)
-	template := volOpts[OptTemplate]
-	fsType := volOpts[OptFstype]
-	maxIops, _ := strconv.ParseUint(volOpts[OptMaxiops], 10, 64)
-	maxBW, _ := strconv.ParseUint(volOpts[OptMaxbw], 10, 64)
-	placementMode, _ := volOpts[OptPlacement]
-	// persistence, _ := volOpts[OptPersistence]
-	cloneSrc, _ := volOpts[OptCloneSrc]
-
-	vOpts := dc.VolOpts{
-		Size:              int(size),
-		Replica:           int(replica),
-		Template:          template,
-		FsType:            fsType,
-		PlacementMode:     placementMode,
-		CloneSrc:          cloneSrc,
-		TotalIopsMax:      int(maxIops),
-		TotalBandwidthMax: int(maxBW),
-		IpPool:            "default",
-	}
+	vOpts := parseVolOpts(volOpts)
+	setDefaults(ctxt, &vOpts)
 
 	co.Debugf(ctxt, "Passed in volume opts: %s", co.Prettify(vOpts))
 
-	vol, err := d.DateraClient.CreateVolume(r.Name, &vOpts, true)
-	if err != nil {
-		return err
+	err = runSteps(ctxt, "Create", []step{
+		{
+			Name: "create-volume",
+			Do: func() error {
+				vol, err = d.createVolume(ctxt, r.Name, &vOpts)
+				return err
+			},
+			Undo: func(ctxt context.Context) error {
+				vol, err := d.rebind(ctxt, vol)
+				if err != nil {
+					return err
+				}
+				return classify("DeleteVolume", r.Name, vol.Delete(true))
+			},
+		},
+		{
+			// Set metadata values for Persistence and FsType so Mount can find them later
+			Name: "set-metadata",
+			Do: func() error {
+				_, err := vol.SetMetadata(createMetadata(volOpts, &vOpts))
+				return classify("SetMetadata", r.Name, err)
+			},
+		},
+	})
+	if IsAlreadyExists(err) {
+		// Lost a race with another host creating the same volume, or a
+		// failed attempt created it.  Either way it is not ours to roll
+		// back
+		co.Debugf(ctxt, "Volume %s was created concurrently", r.Name)
+		if vol, err = d.getVolume(ctxt, r.Name, true, true); err != nil {
+			return err
+		}
+		if err = repairCreate(ctxt, vol, volOpts); err != nil {
+			return err
+		}
+		return d.checkExisting(ctxt, vol, volOpts)
 	}
-
-	// Set metadata values for Persistence and FsType so Mount can find them later
-	if _, err = vol.SetMetadata(&dc.VolMetadata{OptPersistence: DefaultPersistence, OptFstype: vOpts.FsType}); err != nil {
-		return err
-	}
-	return nil
+	return err
 }
 
-func (d *DateraDriver) Remove(r *dv.RemoveRequest) error {
-	ctxt := d.initFunc("Remove")
+func (d *DateraDriver) Remove(r *dv.RemoveRequest) (err error) {
+	ctxt, cancel := d.initFunc("Remove")
+	defer cancel()
+	defer func() { err = timedOut(ctxt, r.Name, err) }()
 	co.Debugf(ctxt, "DateraDriver.Remove: %#v", r)
 	co.Debugf(ctxt, "Removing volume %s", r.Name)
 	d.Mutex.Lock()
@@ -200,111 +324,316 @@ func (d *DateraDriver) Remove(r *dv.RemoveRequest) error {
 	m := d.MountPoint(r.Name)
 
 	co.Debugf(ctxt, "Remove: mountpoint %s", m)
-	vol, err := d.DateraClient.GetVolume(r.Name, false, false)
-	if err != nil {
+	vol, sv, err := d.lookup(ctxt, r.Name)
+	if IsNotFound(err) {
+		// Already gone, nothing left to do
 		co.Debugf(ctxt, "Could not find volume with name %s", r.Name)
+		d.stopAttach(ctxt, r.Name)
+		return nil
+	} else if err != nil {
+		co.Errorf(ctxt, "Failed Remove: %s", err)
+		return err
 	}
-	vol.MountPath = m
-	if err := vol.Unmount(); err != nil {
+	bvol, err := d.backingVolume(ctxt, vol, sv)
+	if err != nil {
+		return err
+	}
+	if err = d.checkIdle(ctxt, bvol, r.Name, sv); err != nil {
+		co.Errorf(ctxt, "Failed Remove: %s", err)
+		return err
+	}
+	d.stopAttach(ctxt, r.Name)
+	d.stopTrim(ctxt, r.Name)
+	if sv != nil {
+		d.stopTrim(ctxt, sv.Source)
+		if err = d.detachSubVolume(ctxt, sv); err != nil {
+			co.Warningf(ctxt, "Error unmounting volume: %s", err)
+		}
+		return d.removeSubVolume(ctxt, sv)
+	}
+	if md, err := getMetadata(vol); err != nil {
+		return err
+	} else if svs := subVolumesOf(r.Name, md); len(svs) != 0 {
+		return fmt.Errorf("Volume %s holds %d subPath volumes, remove them first", r.Name, len(svs))
+	}
+	if d.isStaged(r.Name) {
+		return fmt.Errorf("Volume %s is mounted as the %s of subPath volumes", r.Name, OptSubPathSrc)
+	}
+	if err := releaseLocal(ctxt, vol, m); err != nil {
 		co.Warningf(ctxt, "Error unmounting volume: %s", err)
 	}
-	if err := vol.Delete(true); err != nil {
-		// Don't return an error if we fail to delete the volume
-		// this provides a better user experience.  Log the error
-		// so it can be debugged if needed
-		co.Warningf(ctxt, "Error deleting volume: %s", err)
+	return d.deleteVolume(ctxt, vol)
+}
+
+// deleteVolume soft deletes or deletes a volume Docker no longer knows.  A
+// failed delete is returned or queued for retry according to
+// delete_failures
+func (d *DateraDriver) deleteVolume(ctxt context.Context, vol *dc.Volume) error {
+	if d.Config.SoftDelete.Retention.Duration > 0 {
+		return d.softDelete(ctxt, vol)
+	}
+	if err := classify("Delete", vol.Name, vol.Delete(true)); IsNotFound(err) {
+		return nil
+	} else if IsUnauthorized(err) || err != nil && d.Config.DeleteFailures == DeleteReturn {
+		co.Errorf(ctxt, "Error deleting volume: %s", err)
+		return err
+	} else if err != nil {
+		// Docker forgets the volume either way, so keep retrying the
+		// delete in the background instead of leaking it
+		co.Warningf(ctxt, "Error deleting volume, queueing it for retry: %s", err)
+		if qerr := d.orphans.add(vol, err); qerr != nil {
+			co.Errorf(ctxt, "Could not queue orphaned volume %s: %s", vol.Name, qerr)
+			return err
+		}
 		return nil
 	}
 	return nil
 }
 
-func (d *DateraDriver) List() (*dv.ListResponse, error) {
-	ctxt := d.initFunc("List")
+func (d *DateraDriver) List() (_ *dv.ListResponse, err error) {
+	ctxt, cancel := d.initFunc("List")
+	defer cancel()
+	defer func() { err = timedOut(ctxt, "", err) }()
 	co.Debugf(ctxt, "DateraDriver.List")
 	co.Debugf(ctxt, "Listing volumes")
 	d.Mutex.Lock()
 	defer d.Mutex.Unlock()
 	var vols []*dv.Volume
-	dvols, err := d.DateraClient.ListVolumes(0, 0)
+	var dvols []*dc.Volume
+	err = d.retry(ctxt, "ListVolumes", func() error {
+		var err error
+		dvols, err = d.DateraClient.ListVolumes(0, 0)
+		return classify("ListVolumes", "", err)
+	})
 	if err != nil {
 		return &dv.ListResponse{}, err
 	}
+	orphans, err := d.orphans.names()
+	if err != nil {
+		co.Warningf(ctxt, "Could not read orphan queue %s: %s", d.orphans.path, err)
+	}
 	for _, v := range dvols {
+		if orphans[v.Name] {
+			continue
+		}
+		if md, err := getMetadata(v); err == nil {
+			if _, ok := deletedAt(md); ok {
+				continue
+			}
+		}
 		co.Debugf(ctxt, "Volume Name: %s mount-point: %s", v.Name, d.MountPoint(v.Name))
 		vols = append(vols, &dv.Volume{Name: v.Name, Mountpoint: d.MountPoint(v.Name)})
 	}
+	svs, err := d.scanSubVolumes(ctxt)
+	if err != nil {
+		co.Warningf(ctxt, "Could not list subPath volumes: %s", err)
+	}
+	for _, sv := range svs {
+		co.Debugf(ctxt, "Volume Name: %s mount-point: %s", sv.Name, d.MountPoint(sv.Name))
+		vols = append(vols, &dv.Volume{Name: sv.Name, Mountpoint: d.MountPoint(sv.Name)})
+	}
 	return &dv.ListResponse{Volumes: vols}, nil
 }
 
-func (d *DateraDriver) Get(r *dv.GetRequest) (*dv.GetResponse, error) {
-	ctxt := d.initFunc("Get")
+func (d *DateraDriver) Get(r *dv.GetRequest) (_ *dv.GetResponse, err error) {
+	ctxt, cancel := d.initFunc("Get")
+	defer cancel()
+	defer func() { err = timedOut(ctxt, r.Name, err) }()
 	co.Debugf(ctxt, "DateraDriver.Get: %#v", r)
 	co.Debugf(ctxt, "Get volume: %s", r.Name)
 	d.Mutex.Lock()
 	defer d.Mutex.Unlock()
-	if _, err := d.DateraClient.GetVolume(r.Name, true, true); err == nil {
-		return &dv.GetResponse{Volume: &dv.Volume{Name: r.Name, Mountpoint: d.MountPoint(r.Name), Status: make(map[string]interface{}, 0)}}, nil
+	if vol, sv, err := d.lookup(ctxt, r.Name); err == nil && sv != nil {
+		st := map[string]interface{}{OptSubPath: sv.Path, OptSubPathSrc: sv.Source}
+		if src, err := d.backingVolume(ctxt, vol, sv); err != nil {
+			co.Warningf(ctxt, "Could not read source volume %s: %s", sv.Source, err)
+		} else if md, err := getMetadata(src); err == nil {
+			st["users"] = usersOf(md, r.Name)
+		}
+		return &dv.GetResponse{Volume: &dv.Volume{Name: r.Name, Mountpoint: d.MountPoint(r.Name), Status: st}}, nil
+	} else if err == nil {
+		return &dv.GetResponse{Volume: &dv.Volume{Name: r.Name, Mountpoint: d.MountPoint(r.Name), Status: d.status(ctxt, vol)}}, nil
+	} else if IsNotFound(err) {
+		return &dv.GetResponse{}, fmt.Errorf("Volume not found: %s", r.Name)
 	} else {
-		return &dv.GetResponse{}, nil
+		co.Errorf(ctxt, "Failed Get: %s", err)
+		return &dv.GetResponse{}, err
 	}
 }
 
 func (d *DateraDriver) Path(r *dv.PathRequest) (*dv.PathResponse, error) {
-	ctxt := d.initFunc("Path")
+	ctxt, cancel := d.initFunc("Path")
+	defer cancel()
 	co.Debugf(ctxt, "DateraDriver.Path")
 	return &dv.PathResponse{Mountpoint: d.MountPoint(r.Name)}, nil
 }
 
-func (d *DateraDriver) Mount(r *dv.MountRequest) (*dv.MountResponse, error) {
-	ctxt := d.initFunc("Mount")
+func (d *DateraDriver) Mount(r *dv.MountRequest) (_ *dv.MountResponse, err error) {
+	ctxt, cancel := d.initFunc("Mount")
+	defer cancel()
+	defer func() { err = timedOut(ctxt, r.Name, err) }()
 	co.Debugf(ctxt, "DateraDriver.Mount: %#v", r)
-	d.Mutex.Lock()
-	defer d.Mutex.Unlock()
 	m := d.MountPoint(r.Name)
 	co.Debugf(ctxt, "Mounting volume %s on %s\n", r.Name, m)
 
-	if _, err := d.DateraClient.GetVolume(r.Name, false, false); err != nil {
-		err := fmt.Errorf("Volume not found: %s", m)
+	op, err := d.prepareAttach(ctxt, r.Name)
+	if err != nil {
 		co.Errorf(ctxt, "Failed Mount: %s", err)
 		return &dv.MountResponse{}, err
 	}
 
-	err := doMount(ctxt, d, r.Name, DefaultPersistence, DefaultFS)
-	if err != nil {
+	// The attach runs under its own deadline so it can outlive this request
+	if err = d.waitAttach(ctxt, op); err != nil {
+		return &dv.MountResponse{}, err
+	}
+	if err = d.recordMount(ctxt, op, r.ID); err != nil {
+		co.Errorf(ctxt, "Failed Mount: %s", err)
 		return &dv.MountResponse{}, err
 	}
 	return &dv.MountResponse{Mountpoint: m}, nil
 }
 
-func (d *DateraDriver) Unmount(r *dv.UnmountRequest) error {
-	ctxt := d.initFunc("Unmount")
+// recordMount records the container behind a successful Mount as a user of
+// the volume.  An Unmount may have detached the volume after the attach
+// finished, in which case the Mount has to be retried
+func (d *DateraDriver) recordMount(ctxt context.Context, op *attachOp, id string) error {
+	d.Mutex.Lock()
+	defer d.Mutex.Unlock()
+	if d.attaches[op.name] != op {
+		return fmt.Errorf("Volume %s was unmounted while being mounted, retry the Mount", op.name)
+	}
+	op.users[id] = true
+	vol, sv, err := d.lookup(ctxt, op.name)
+	if err == nil {
+		vol, err = d.backingVolume(ctxt, vol, sv)
+	}
+	if err == nil {
+		err = d.addUser(ctxt, vol, op.name, id)
+	}
+	if err != nil {
+		// The volume is usable, only who-uses is affected
+		co.Warningf(ctxt, "Could not record container %s using volume %s: %s", id, op.name, err)
+	}
+	return nil
+}
+
+func (d *DateraDriver) Unmount(r *dv.UnmountRequest) (err error) {
+	ctxt, cancel := d.initFunc("Unmount")
+	defer cancel()
+	defer func() { err = timedOut(ctxt, r.Name, err) }()
 	co.Debugf(ctxt, "DateraDriver.Unmount: %#v", r)
 	d.Mutex.Lock()
 	defer d.Mutex.Unlock()
 	m := d.MountPoint(r.Name)
 	co.Debugf(ctxt, "Driver::Unmount: unmounting volume %s from %s\n", r.Name, m)
 
-	vol, err := d.DateraClient.GetVolume(r.Name, false, false)
+	vol, sv, err := d.lookup(ctxt, r.Name)
+	if IsNotFound(err) {
+		// The backing volume is gone so there's no ACL left to clean up
+		co.Warningf(ctxt, "Could not find volume with name %s", r.Name)
+		d.stopAttach(ctxt, r.Name)
+		return nil
+	} else if err != nil {
+		co.Errorf(ctxt, "Failed Unmount: %s", err)
+		return err
+	}
+	// Docker mounts a volume once per container, it stays attached until
+	// the last container using it on this host is gone
+	left, err := d.unmountUser(ctxt, vol, sv, r.Name, r.ID)
 	if err != nil {
-		co.Debugf(ctxt, "Could not find volume with name %s", r.Name)
+		co.Errorf(ctxt, "Failed Unmount: %s", err)
+		return err
+	} else if left != 0 {
+		co.Infof(ctxt, "Volume %s is still used by %d containers on this host", r.Name, left)
+		return nil
 	}
-	vol.MountPath = m
-	if err := vol.Unmount(); err != nil {
+	d.stopAttach(ctxt, r.Name)
+	d.stopTrim(ctxt, r.Name)
+	if sv != nil {
+		// The source may be being trimmed through its staging directory,
+		// an interrupted trim is simply retried by the next pass
+		d.stopTrim(ctxt, sv.Source)
+		return d.detachSubVolume(ctxt, sv)
+	}
+	return d.detach(ctxt, vol, m)
+}
+
+// unmountUser drops the container behind an Unmount from the users of a
+// volume and returns the number of containers still using it on this host.
+// The attach's own count is authoritative, the metadata is only relied on
+// when this host has no record of the attach, e.g. after a driver restart.
+// d.Mutex must be held
+func (d *DateraDriver) unmountUser(ctxt context.Context, vol *dc.Volume, sv *subVolume, name, id string) (int, error) {
+	bvol, err := d.backingVolume(ctxt, vol, sv)
+	left := 0
+	if err == nil {
+		left, err = d.removeUser(ctxt, bvol, name, id)
+	}
+	if op, ok := d.attaches[name]; ok && op.finished() && op.err == nil {
+		if err != nil {
+			// Only who-uses is affected
+			co.Warningf(ctxt, "Could not update users of volume %s: %s", name, err)
+		}
+		delete(op.users, id)
+		return len(op.users), nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("Could not tell whether other containers use volume %s, not unmounting: %s", name, err)
+	}
+	return left, nil
+}
+
+// detach undoes an attach of a volume from mountpoint m on this host and
+// removes this host's initiator from the volume's ACL
+func (d *DateraDriver) detach(ctxt context.Context, vol *dc.Volume, m string) error {
+	if err := releaseLocal(ctxt, vol, m); err != nil {
 		co.Errorf(ctxt, "Unmount Error: %s", err)
+	} else {
+		d.markClean(ctxt, vol)
 	}
-	init, err := d.DateraClient.CreateGetInitiator()
+	init, err := d.getInitiator(ctxt)
 	if err != nil {
 		co.Warning(ctxt, err)
+		if IsUnauthorized(err) {
+			return err
+		}
+		return nil
 	}
-	err = vol.UnregisterAcl(init)
-	if err != nil {
+	err = d.retry(ctxt, "UnregisterAcl", func() error {
+		return classify("UnregisterAcl", vol.Name, vol.UnregisterAcl(init))
+	})
+	if IsUnauthorized(err) {
+		co.Error(ctxt, err)
+		return err
+	} else if err != nil {
 		co.Warning(ctxt, err)
 	}
+	if err = d.releaseLease(ctxt, vol, init); err != nil {
+		co.Warningf(ctxt, "Could not release lease on volume %s: %s", vol.Name, err)
+	}
+	d.touch(ctxt, vol)
 	return nil
 }
 
+// markClean records that a filesystem volume mounted read-write was cleanly
+// unmounted so the next Mount can skip checking it
+func (d *DateraDriver) markClean(ctxt context.Context, vol *dc.Volume) {
+	md, err := getMetadata(vol)
+	if err != nil {
+		co.Warningf(ctxt, "Could not read metadata of volume %s: %s", vol.Name, err)
+		return
+	}
+	if md[OptAccessType] == AccessBlock || d.Config.ReadOnly || isReadOnly(md) || md[MdCleanUnmount] == "true" {
+		return
+	}
+	if _, err = vol.SetMetadata(&dc.VolMetadata{MdCleanUnmount: "true"}); err != nil {
+		co.Warningf(ctxt, "Could not mark volume %s cleanly unmounted: %s", vol.Name, err)
+	}
+}
+
 func (d *DateraDriver) Capabilities() *dv.CapabilitiesResponse {
-	ctxt := d.initFunc("Capabilities")
+	ctxt, cancel := d.initFunc("Capabilities")
+	defer cancel()
 	co.Debugf(ctxt, "DateraDriver.Capabilities")
 	// This driver is global scope since created volumes are not bound to the
 	// engine that created them.
@@ -315,11 +644,183 @@ func (d *DateraDriver) MountPoint(name string) string {
 	return filepath.Join(MountLoc, name)
 }
 
-func (d *DateraDriver) initFunc(reqName string) context.Context {
+// isReadOnly reports whether the volume's metadata marks it read-only
+func isReadOnly(md dc.VolMetadata) bool {
+	ro, _ := strconv.ParseBool(md[OptReadOnly])
+	return ro
+}
+
+// isEncrypted reports whether the volume's metadata marks it encrypted
+func isEncrypted(md dc.VolMetadata) bool {
+	enc, _ := strconv.ParseBool(md[OptEncrypted])
+	return enc
+}
+
+// SetReadOnly changes the readOnly flag of a volume.  The change applies the
+// next time the volume is attached, hosts that have it attached read-write
+// refuse further Mounts of it until then
+func (d *DateraDriver) SetReadOnly(name string, ro bool) (err error) {
+	ctxt, cancel := d.initFunc("SetReadOnly")
+	defer cancel()
+	defer func() { err = timedOut(ctxt, name, err) }()
+	d.Mutex.Lock()
+	defer d.Mutex.Unlock()
+	vol, err := d.getVolume(ctxt, name, false, true)
+	if err != nil {
+		return err
+	}
+	co.Infof(ctxt, "Setting %s of volume %s to %t", OptReadOnly, name, ro)
+	_, err = vol.SetMetadata(&dc.VolMetadata{OptReadOnly: strconv.FormatBool(ro)})
+	return classify("SetMetadata", name, err)
+}
+
+// releaseLocal undoes the host side of an attach.  Filesystem volumes are
+// unmounted, block volumes have their device node removed and are logged out
+func releaseLocal(ctxt context.Context, vol *dc.Volume, m string) error {
+	md, err := getMetadata(vol)
+	if err != nil {
+		co.Warningf(ctxt, "Could not read metadata of volume %s, assuming a filesystem: %s", vol.Name, err)
+	}
+	block := md[OptAccessType] == AccessBlock
+	if !block && !isEncrypted(md) {
+		vol.MountPath = m
+		return vol.Unmount()
+	}
+	if block {
+		err = removeBlock(ctxt, m)
+	} else {
+		// The filesystem lives on the dm-crypt mapping, so it has to be
+		// unmounted before the mapping can be closed
+		err = unmountPath(ctxt, m)
+	}
+	if err != nil {
+		return err
+	}
+	if isEncrypted(md) {
+		if err = closeCrypt(ctxt, vol.Name); err != nil {
+			return err
+		}
+	}
+	return classify("Logout", vol.Name, vol.Logout())
+}
+
+// status builds the status reported for a volume by Get
+func (d *DateraDriver) status(ctxt context.Context, vol *dc.Volume) map[string]interface{} {
+	st := map[string]interface{}{}
+	md, err := getMetadata(vol)
+	if err != nil {
+		co.Warningf(ctxt, "Could not read metadata of volume %s: %s", vol.Name, err)
+		return st
+	}
+	access := md[OptAccessType]
+	if access == "" {
+		access = AccessFilesystem
+	}
+	st[OptAccessType] = access
+	if access == AccessBlock {
+		node := BlockDevicePath(d.MountPoint(vol.Name))
+		if _, err := os.Stat(node); err == nil {
+			st["devicePath"] = node
+		}
+	} else {
+		st[OptFstype] = md[OptFstype]
+		st[MdCleanUnmount] = md[MdCleanUnmount] == "true"
+		if res, ok := d.lastTrim(vol.Name); ok {
+			st["lastTrim"] = res.Last.Format(time.RFC3339)
+			st["trimmedBytes"] = res.Bytes
+		}
+	}
+	st[OptReadOnly] = d.Config.ReadOnly || isReadOnly(md)
+	st[OptEncrypted] = isEncrypted(md)
+	st["users"] = usersOf(md, vol.Name)
+	for _, k := range []string{OptUid, OptGid, OptMode, MdTakeover} {
+		if v, ok := md[k]; ok && v != "" {
+			st[k] = v
+		}
+	}
+	return st
+}
+
+// getVolume looks up a volume on the backend, retrying transient failures
+// and classifying any error
+func (d *DateraDriver) getVolume(ctxt context.Context, name string, snaps, metadata bool) (*dc.Volume, error) {
+	var vol *dc.Volume
+	err := d.retry(ctxt, "GetVolume", func() error {
+		var err error
+		vol, err = d.DateraClient.GetVolume(name, snaps, metadata)
+		return classify("GetVolume", name, err)
+	})
+	return vol, err
+}
+
+// rebind looks vol up again bound to ctxt.  A volume makes its backend
+// calls with the context it was fetched with, which is already done when a
+// rollback runs after the request expired
+func (d *DateraDriver) rebind(ctxt context.Context, vol *dc.Volume) (*dc.Volume, error) {
+	ctxt = d.DateraClient.WithContext(ctxt)
+	v, err := d.getVolume(ctxt, vol.Name, false, true)
+	if err != nil {
+		return nil, err
+	}
+	// Filled in by Login and Mount, not by the lookup
+	v.DevicePath = vol.DevicePath
+	v.MountPath = vol.MountPath
+	return v, nil
+}
+
+// getInitiator returns this host's initiator, creating it on the backend if
+// needed
+func (d *DateraDriver) getInitiator(ctxt context.Context) (*dc.Initiator, error) {
+	var init *dc.Initiator
+	err := d.retry(ctxt, "CreateGetInitiator", func() error {
+		var err error
+		init, err = d.DateraClient.CreateGetInitiator()
+		return classify("CreateGetInitiator", "", err)
+	})
+	return init, err
+}
+
+// createVolume creates a volume on the backend.  CreateVolume isn't
+// idempotent, so before each retry the volume is looked up in case the
+// failed attempt actually created it.  Another host may have created it
+// just as well, so a volume found that way is reported as AlreadyExists
+// rather than as created by this call
+func (d *DateraDriver) createVolume(ctxt context.Context, name string, vOpts *dc.VolOpts) (*dc.Volume, error) {
+	var vol *dc.Volume
+	attempt := 0
+	err := d.retry(ctxt, "CreateVolume", func() error {
+		attempt++
+		if attempt > 1 {
+			_, err := d.DateraClient.GetVolume(name, false, false)
+			if err == nil {
+				co.Debugf(ctxt, "Volume %s exists after a failed attempt to create it", name)
+				return &BackendError{Kind: ErrAlreadyExists, Op: "CreateVolume", Name: name,
+					Err: fmt.Errorf("volume appeared after a failed attempt to create it")}
+			} else if err = classify("GetVolume", name, err); !IsNotFound(err) {
+				return err
+			}
+		}
+		var err error
+		vol, err = d.DateraClient.CreateVolume(name, vOpts, true)
+		return classify("CreateVolume", name, err)
+	})
+	return vol, err
+}
+
+// initFunc builds the context for a driver request.  The context carries the
+// trace ID used in logging and the deadline configured for the operation,
+// which is propagated to backend calls and host commands
+func (d *DateraDriver) initFunc(reqName string) (context.Context, context.CancelFunc) {
 	ctxt := context.WithValue(topctxt, co.TraceId, co.GenId())
 	ctxt = context.WithValue(ctxt, co.ReqName, reqName)
+	cancel := func() {}
+	if d.Config != nil {
+		if t := d.Config.Timeouts.For(reqName); t > 0 {
+			ctxt, cancel = context.WithTimeout(ctxt, t)
+		}
+	}
 	ctxt = d.DateraClient.WithContext(ctxt)
-	return ctxt
+	return ctxt, cancel
 }
 
 func setDefaults(ctxt context.Context, volOpts *dc.VolOpts) {
@@ -349,36 +850,415 @@ func setDefaults(ctxt context.Context, volOpts *dc.VolOpts) {
 		volOpts.Size, volOpts.FsType, volOpts.Replica, volOpts.PlacementMode)
 }
 
-func doMount(ctxt context.Context, d *DateraDriver, name, pmode, fs string) error {
-	m := d.MountPoint(name)
-	vol, err := d.DateraClient.GetVolume(name, true, true)
+func parseVolOpts(volOpts map[string]string) dc.VolOpts {
+	size, _ := strconv.ParseUint(volOpts[OptSize], 10, 64)
+	replica, _ := strconv.ParseUint(volOpts[OptReplica], 10, 8)
+	maxIops, _ := strconv.ParseUint(volOpts[OptMaxiops], 10, 64)
+	maxBW, _ := strconv.ParseUint(volOpts[OptMaxbw], 10, 64)
+	return dc.VolOpts{
+		Size:              int(size),
+		Replica:           int(replica),
+		Template:          volOpts[OptTemplate],
+		FsType:            volOpts[OptFstype],
+		PlacementMode:     volOpts[OptPlacement],
+		CloneSrc:          volOpts[OptCloneSrc],
+		TotalIopsMax:      int(maxIops),
+		TotalBandwidthMax: int(maxBW),
+		IpPool:            "default",
+	}
+}
+
+// validateVolOpts rejects invalid options before anything is created on the
+// backend
+func validateVolOpts(name string, volOpts map[string]string, conf *Config) error {
+	_, sp := volOpts[OptSubPath]
+	_, src := volOpts[OptSubPathSrc]
+	if sp || src {
+		// The source volume's options apply to subPath volumes
+		if !sp || !src {
+			return fmt.Errorf("%s and %s must be used together", OptSubPath, OptSubPathSrc)
+		}
+		if len(volOpts) != 2 {
+			return fmt.Errorf("No other options can be used with %s", OptSubPath)
+		}
+		return checkSubPath(volOpts[OptSubPath])
+	}
+	if fs := volOpts[OptFstype]; fs != "" {
+		if err := checkFsType(fs); err != nil {
+			return err
+		}
+	}
+	for _, k := range []string{OptUid, OptGid} {
+		if v, ok := volOpts[k]; ok {
+			if id, err := strconv.Atoi(v); err != nil || id < 0 {
+				return fmt.Errorf("Invalid %s: %s", k, v)
+			}
+		}
+	}
+	if v, ok := volOpts[OptMode]; ok {
+		if mode, err := strconv.ParseUint(v, 8, 32); err != nil || mode > 07777 {
+			return fmt.Errorf("Invalid %s, must be octal: %s", OptMode, v)
+		}
+	}
+	for _, k := range []string{OptReadOnly, OptEncrypted, OptOwnerMount, OptTrim, OptForceAttach} {
+		if v, ok := volOpts[k]; ok {
+			if _, err := strconv.ParseBool(v); err != nil {
+				return fmt.Errorf("Invalid %s: %s", k, v)
+			}
+		}
+	}
+	if enc, _ := strconv.ParseBool(volOpts[OptEncrypted]); enc {
+		if len(conf.KeyCommand) == 0 && conf.KeyDir == "" {
+			return fmt.Errorf("%s volumes require key_dir or key_command in the driver config", OptEncrypted)
+		}
+	}
+	switch volOpts[OptAccessType] {
+	case "", AccessFilesystem:
+	case AccessBlock:
+		for _, k := range []string{OptFstype, OptMkfsOpts, OptMountOpts, OptFormatPol, OptUid, OptGid, OptMode, OptFsckPolicy, OptTrim} {
+			if _, ok := volOpts[k]; ok {
+				return fmt.Errorf("%s can't be used with %s=%s", k, OptAccessType, AccessBlock)
+			}
+		}
+	default:
+		return fmt.Errorf("Invalid %s: %s", OptAccessType, volOpts[OptAccessType])
+	}
+	switch volOpts[OptFormatPol] {
+	case "", FormatNever, FormatIfBlank:
+	case FormatForce:
+		if volOpts[OptFormatConf] != name {
+			return fmt.Errorf("%s=%s requires --opt %s=%s", OptFormatPol, FormatForce, OptFormatConf, name)
+		}
+	default:
+		return fmt.Errorf("Invalid %s: %s", OptFormatPol, volOpts[OptFormatPol])
+	}
+	if v, ok := volOpts[OptTtl]; ok {
+		if ttl, err := time.ParseDuration(v); err != nil || ttl <= 0 {
+			return fmt.Errorf("Invalid %s, must be a duration such as 72h: %s", OptTtl, v)
+		}
+	}
+	switch volOpts[OptFsckPolicy] {
+	case "", FsckNever, FsckCheck, FsckRepair:
+	default:
+		return fmt.Errorf("Invalid %s: %s", OptFsckPolicy, volOpts[OptFsckPolicy])
+	}
+	if err := checkMkfsOpts(splitMkfsOpts(volOpts[OptMkfsOpts]), conf); err != nil {
+		return err
+	}
+	if err := checkMountOpts(splitMountOpts(volOpts[OptMountOpts]), conf); err != nil {
+		return err
+	}
+	return nil
+}
+
+// createMetadata builds the metadata written to a volume during Create.  The
+// presence of the FsType key marks the volume as fully created
+func createMetadata(volOpts map[string]string, vOpts *dc.VolOpts) *dc.VolMetadata {
+	// A new volume has nothing to check on its first mount
+	md := dc.VolMetadata{OptPersistence: DefaultPersistence, OptFstype: vOpts.FsType, MdCleanUnmount: "true"}
+	md[MdLastUsed] = time.Now().UTC().Format(time.RFC3339)
+	md[OptFormatPol] = FormatIfBlank
+	if p := volOpts[OptFormatPol]; p != "" {
+		md[OptFormatPol] = p
+	}
+	md[OptAccessType] = AccessFilesystem
+	for _, k := range []string{OptMkfsOpts, OptMountOpts, OptAccessType, OptUid, OptGid, OptMode, OptFsckPolicy, OptTtl} {
+		if v := volOpts[k]; v != "" {
+			md[k] = v
+		}
+	}
+	if ro, _ := strconv.ParseBool(volOpts[OptReadOnly]); ro {
+		md[OptReadOnly] = "true"
+	}
+	if enc, _ := strconv.ParseBool(volOpts[OptEncrypted]); enc {
+		md[OptEncrypted] = "true"
+	}
+	if om, _ := strconv.ParseBool(volOpts[OptOwnerMount]); om {
+		md[OptOwnerMount] = "true"
+	}
+	if trim, err := strconv.ParseBool(volOpts[OptTrim]); err == nil && !trim {
+		md[OptTrim] = "false"
+	}
+	if force, _ := strconv.ParseBool(volOpts[OptForceAttach]); force {
+		md[OptForceAttach] = "true"
+	}
+	return &md
+}
+
+func getMetadata(vol *dc.Volume) (dc.VolMetadata, error) {
+	md, err := vol.GetMetadata()
 	if err != nil {
-		co.Debugf(ctxt, "Couldn't find volume with name: %s", name)
+		return nil, classify("GetMetadata", vol.Name, err)
+	}
+	if md == nil {
+		return dc.VolMetadata{}, nil
+	}
+	return *md, nil
+}
+
+// repairCreate finishes a volume left behind by an earlier Create that failed
+// after the AppInstance was created but before its metadata was written
+func repairCreate(ctxt context.Context, vol *dc.Volume, volOpts map[string]string) error {
+	md, err := getMetadata(vol)
+	if err != nil {
+		return err
+	}
+	if _, ok := md[OptFstype]; ok {
 		return nil
 	}
-	init, err := d.DateraClient.CreateGetInitiator()
+	co.Warningf(ctxt, "Volume %s is missing creation metadata, repairing", vol.Name)
+	vOpts := parseVolOpts(volOpts)
+	setDefaults(ctxt, &vOpts)
+	_, err = vol.SetMetadata(createMetadata(volOpts, &vOpts))
+	return classify("SetMetadata", vol.Name, err)
+}
+
+func doMount(ctxt context.Context, d *DateraDriver, name, m string) error {
+	vol, err := d.getVolume(ctxt, name, true, true)
 	if err != nil {
+		co.Debugf(ctxt, "Couldn't find volume with name: %s", name)
 		return err
 	}
-	if err = vol.RegisterAcl(init); err != nil {
+	md, err := getMetadata(vol)
+	if err != nil {
 		return err
 	}
-	// TODO: Fix multipath support post-refactor
-	if err := vol.Login(false, false); err != nil {
-		co.Errorf(ctxt, "Couldn't login volume, error: %s", err)
+	fs := md[OptFstype]
+	if fs == "" {
+		fs = DefaultFS
+	}
+	// Options are checked again in case the allow-list changed since Create
+	mountOpts := splitMountOpts(md[OptMountOpts])
+	if err = checkMountOpts(mountOpts, d.Config); err != nil {
 		return err
 	}
-	diskPath := vol.DevicePath
-	if diskPath == "" {
-		err = fmt.Errorf("Disk path is not populated")
-		co.Error(ctxt, err)
+	ro := d.Config.ReadOnly || isReadOnly(md)
+	if ro {
+		co.Debugf(ctxt, "Volume %s will be attached read-only", name)
+		mountOpts = append(mountOpts, "ro")
+	}
+	mkfsOpts := splitMkfsOpts(md[OptMkfsOpts])
+	if err = checkMkfsOpts(mkfsOpts, d.Config); err != nil {
 		return err
 	}
-	if err = vol.Format(fs, []string{}, 180); err != nil {
+	init, err := d.getInitiator(ctxt)
+	if err != nil {
 		return err
 	}
-	if err = vol.Mount(m, []string{}, fs); err != nil {
+	// A staged subPath source or a volume left attached across a driver
+	// restart is still mounted and in use, it must not be checked or undone
+	mounted, err := isMounted(m)
+	if err != nil {
 		return err
 	}
-	return nil
+	// Each attach step is paired with the step that reverses it so a failed
+	// Mount doesn't leave the host logged in or the volume exported to it.
+	// Access this host already had is left alone
+	registered, loggedIn := false, false
+	steps := []step{
+		{
+			// Before touching the ACL so a refused attach leaves the
+			// other host's access intact
+			Name: "fence",
+			Do: func() error {
+				return d.fence(ctxt, vol, md, init)
+			},
+		},
+		{
+			Name: "acquire-lease",
+			Do: func() error {
+				if d.Config.Lease.Duration.Duration == 0 {
+					return nil
+				}
+				return d.writeLease(ctxt, vol, init)
+			},
+			Undo: func(ctxt context.Context) error {
+				vol, err := d.rebind(ctxt, vol)
+				if err != nil {
+					return err
+				}
+				return d.releaseLease(ctxt, vol, init)
+			},
+		},
+		{
+			Name: "register-acl",
+			Do: func() error {
+				acl, sessions, err := d.initiators(ctxt, vol)
+				if err != nil {
+					return err
+				}
+				registered, loggedIn = acl[init.Iqn], sessions[init.Iqn]
+				return d.retry(ctxt, "RegisterAcl", func() error {
+					return classify("RegisterAcl", name, vol.RegisterAcl(init))
+				})
+			},
+			Undo: func(ctxt context.Context) error {
+				if registered {
+					return nil
+				}
+				vol, err := d.rebind(ctxt, vol)
+				if err != nil {
+					return err
+				}
+				return classify("UnregisterAcl", name, vol.UnregisterAcl(init))
+			},
+		},
+		{
+			// TODO: Fix multipath support post-refactor
+			Name: "login",
+			Do: func() error {
+				err := d.retry(ctxt, "Login", func() error {
+					return classify("Login", name, vol.Login(false, false))
+				})
+				if err != nil {
+					co.Errorf(ctxt, "Couldn't login volume, error: %s", err)
+				}
+				return err
+			},
+			Undo: func(ctxt context.Context) error {
+				if loggedIn {
+					return nil
+				}
+				vol, err := d.rebind(ctxt, vol)
+				if err != nil {
+					return err
+				}
+				return classify("Logout", name, vol.Logout())
+			},
+		},
+		{
+			Name: "check-device",
+			Do: func() error {
+				if vol.DevicePath == "" {
+					return fmt.Errorf("Disk path is not populated")
+				}
+				return nil
+			},
+		},
+	}
+	if isEncrypted(md) {
+		opened := false
+		steps = append(steps, step{
+			Name: "open-encryption",
+			Do: func() error {
+				if _, err := os.Stat(CryptDevicePath(name)); err == nil {
+					opened = true
+				}
+				mapped, err := d.openCrypt(ctxt, name, vol.DevicePath, ro)
+				if err != nil {
+					return err
+				}
+				// Everything after this point, including the client's
+				// Mount, works on the decrypted device
+				vol.DevicePath = mapped
+				return nil
+			},
+			Undo: func(ctxt context.Context) error {
+				if opened || mounted {
+					return nil
+				}
+				return closeCrypt(ctxt, name)
+			},
+		})
+	}
+	if md[OptAccessType] == AccessBlock {
+		// Block volumes skip the filesystem entirely
+		exposed := false
+		steps = append(steps, step{
+			Name: "expose-device",
+			Do: func() error {
+				if _, err := os.Stat(BlockDevicePath(m)); err == nil {
+					exposed = true
+				}
+				return exposeBlock(ctxt, vol.DevicePath, m, ro)
+			},
+			Undo: func(ctxt context.Context) error {
+				if exposed {
+					return nil
+				}
+				return removeBlock(ctxt, m)
+			},
+		})
+		return runSteps(ctxt, "Mount", steps)
+	}
+	formatted := false
+	if mounted {
+		co.Debugf(ctxt, "Volume %s is already mounted at %s, skipping format and checks", name, m)
+	} else {
+		steps = append(steps, []step{
+			{
+				Name: "format",
+				Do: func() error {
+					if ro {
+						// Never write to a read-only volume, only make sure
+						// there is a filesystem we can mount
+						return checkFormatted(ctxt, vol, fs)
+					}
+					formatted, err = formatVolume(ctxt, vol, md, fs, mkfsOpts)
+					return err
+				},
+			},
+			{
+				Name: "check-filesystem",
+				Do: func() error {
+					if formatted || md[MdCleanUnmount] == "true" {
+						return nil
+					}
+					return fsckVolume(ctxt, vol, md, fs, ro)
+				},
+			},
+			{
+				Name: "mount",
+				Do: func() error {
+					err := vol.Mount(m, mountOpts, fs)
+					if err != nil && !formatted && md[MdCleanUnmount] != "true" {
+						return diagnoseMount(ctxt, vol, md, fs, err)
+					}
+					return err
+				},
+				Undo: func(ctxt context.Context) error {
+					return unmountPath(ctxt, m)
+				},
+			},
+		}...)
+	}
+	steps = append(steps, []step{
+		{
+			// Cleared until a successful Unmount so a host crash leaves
+			// the volume marked for checking.  A failed Mount leaves it
+			// cleared too, costing at most an unneeded check
+			Name: "mark-in-use",
+			Do: func() error {
+				if ro {
+					return nil
+				}
+				_, err := vol.SetMetadata(&dc.VolMetadata{MdCleanUnmount: "false"})
+				return classify("SetMetadata", name, err)
+			},
+		},
+		{
+			Name: "grow",
+			Do: func() error {
+				if ro {
+					return nil
+				}
+				// Not fatal, the volume is usable at its old size
+				if err := growFS(ctxt, vol.DevicePath, m, fs); err != nil {
+					co.Warningf(ctxt, "Could not grow filesystem of volume %s: %s", name, err)
+				}
+				return nil
+			},
+		},
+		{
+			Name: "set-ownership",
+			Do: func() error {
+				reapply, _ := strconv.ParseBool(md[OptOwnerMount])
+				if ro || !(formatted || reapply) {
+					return nil
+				}
+				return setOwnership(ctxt, md, m)
+			},
+		},
+	}...)
+	return runSteps(ctxt, "Mount", steps)
 }
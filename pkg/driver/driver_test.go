@@ -0,0 +1,66 @@
+package driver
+
+import (
+	"testing"
+)
+
+func TestValidateVolOpts(t *testing.T) {
+	conf := DefaultConfig()
+	noKeys := DefaultConfig()
+	noKeys.KeyDir = ""
+	tests := []struct {
+		name    string
+		opts    map[string]string
+		conf    *Config
+		wantErr bool
+	}{
+		{"no options", map[string]string{}, conf, false},
+		{"defaults spelled out", map[string]string{OptSize: "16", OptFstype: "ext4", OptFormatPol: FormatIfBlank}, conf, false},
+		{"force format", map[string]string{OptFormatPol: FormatForce, OptFormatConf: "vol1"}, conf, false},
+		{"force format unconfirmed", map[string]string{OptFormatPol: FormatForce}, conf, true},
+		{"force format wrong name", map[string]string{OptFormatPol: FormatForce, OptFormatConf: "vol2"}, conf, true},
+		{"bad format policy", map[string]string{OptFormatPol: "always"}, conf, true},
+		{"mkfs opts", map[string]string{OptMkfsOpts: "-m 1 -E nodiscard"}, conf, false},
+		{"mkfs opt not allowed", map[string]string{OptMkfsOpts: "-F"}, conf, true},
+		{"mount opts", map[string]string{OptMountOpts: "noatime,commit=60"}, conf, false},
+		{"mount opt not allowed", map[string]string{OptMountOpts: "noatime,exec"}, conf, true},
+		{"xfs", map[string]string{OptFstype: "xfs"}, conf, false},
+		{"btrfs", map[string]string{OptFstype: "btrfs"}, conf, false},
+		{"unsupported fs", map[string]string{OptFstype: "ntfs"}, conf, true},
+		{"block", map[string]string{OptAccessType: AccessBlock}, conf, false},
+		{"block with fs", map[string]string{OptAccessType: AccessBlock, OptFstype: "xfs"}, conf, true},
+		{"bad access type", map[string]string{OptAccessType: "object"}, conf, true},
+		{"read-only", map[string]string{OptReadOnly: "true"}, conf, false},
+		{"bad read-only", map[string]string{OptReadOnly: "yes"}, conf, true},
+		{"encrypted", map[string]string{OptEncrypted: "true"}, conf, false},
+		{"bad encrypted", map[string]string{OptEncrypted: "yes"}, conf, true},
+		{"encrypted without keys", map[string]string{OptEncrypted: "true"}, noKeys, true},
+		{"uid", map[string]string{OptUid: "1000", OptGid: "0"}, conf, false},
+		{"negative uid", map[string]string{OptUid: "-1"}, conf, true},
+		{"octal mode", map[string]string{OptMode: "0750"}, conf, false},
+		{"setgid mode", map[string]string{OptMode: "2775"}, conf, false},
+		{"decimal mode", map[string]string{OptMode: "999"}, conf, true},
+		{"mode too large", map[string]string{OptMode: "17777"}, conf, true},
+		{"subPath", map[string]string{OptSubPath: "data/app1", OptSubPathSrc: "shared"}, conf, false},
+		{"subPath without source", map[string]string{OptSubPath: "data/app1"}, conf, true},
+		{"subPathSrc alone", map[string]string{OptSubPathSrc: "shared"}, conf, true},
+		{"subPath with options", map[string]string{OptSubPath: "data", OptSubPathSrc: "shared", OptSize: "10"}, conf, true},
+		{"subPath escaping", map[string]string{OptSubPath: "../other", OptSubPathSrc: "shared"}, conf, true},
+		{"fsck policy", map[string]string{OptFsckPolicy: FsckCheck}, conf, false},
+		{"bad fsck policy", map[string]string{OptFsckPolicy: "always"}, conf, true},
+		{"trim", map[string]string{OptTrim: "false"}, conf, false},
+		{"bad trim", map[string]string{OptTrim: "never"}, conf, true},
+		{"block with trim", map[string]string{OptAccessType: AccessBlock, OptTrim: "true"}, conf, true},
+		{"force attach", map[string]string{OptForceAttach: "1"}, conf, false},
+		{"bad force attach", map[string]string{OptForceAttach: "always"}, conf, true},
+		{"ttl", map[string]string{OptTtl: "72h"}, conf, false},
+		{"ttl days", map[string]string{OptTtl: "3d"}, conf, true},
+		{"zero ttl", map[string]string{OptTtl: "0s"}, conf, true},
+	}
+	for _, tt := range tests {
+		err := validateVolOpts("vol1", tt.opts, tt.conf)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: validateVolOpts(%v) = %v, want error: %t", tt.name, tt.opts, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+
+	co "github.com/Datera/docker-driver/pkg/common"
+)
+
+// ErrorKind classifies failures returned by the Datera backend so callers can
+// handle them deliberately instead of matching on error strings
+type ErrorKind int
+
+const (
+	ErrUnknown ErrorKind = iota
+	ErrNotFound
+	ErrAlreadyExists
+	ErrUnauthorized
+	ErrConflict
+	ErrTransient
+	ErrTimeout
+)
+
+func (k ErrorKind) String() string {
+	switch k {
+	case ErrNotFound:
+		return "NotFound"
+	case ErrAlreadyExists:
+		return "AlreadyExists"
+	case ErrUnauthorized:
+		return "Unauthorized"
+	case ErrConflict:
+		return "Conflict"
+	case ErrTransient:
+		return "Transient"
+	case ErrTimeout:
+		return "Timeout"
+	}
+	return "Unknown"
+}
+
+// BackendError wraps an error returned by the Datera client along with its
+// classification and the operation that produced it
+type BackendError struct {
+	Kind ErrorKind
+	Op   string
+	Name string
+	Err  error
+}
+
+func (e *BackendError) Error() string {
+	if e.Name == "" {
+		return fmt.Sprintf("%s failed [%s]: %s", e.Op, e.Kind, e.Err)
+	}
+	return fmt.Sprintf("%s %s failed [%s]: %s", e.Op, e.Name, e.Kind, e.Err)
+}
+
+// The client returns API errors as pretty printed ApiErrorResponse objects,
+// so classification has to fall back on the error name and http code.  The
+// ACL calls format them with %#v instead, where the code shows up as Http:
+var (
+	httpCodeRe = regexp.MustCompile(`(?:"http"|Http):\s*(\d+)`)
+
+	kindMatchers = []struct {
+		kind    ErrorKind
+		matches []string
+		codes   []string
+	}{
+		{ErrNotFound, []string{"NotFoundError", "not exist", "not found"}, []string{"404"}},
+		{ErrAlreadyExists, []string{"already exist"}, nil},
+		{ErrUnauthorized, []string{"AuthFailedError", "PermissionDeniedError",
+			"InvalidSessionKeyError", "Unauthorized"}, []string{"401", "403"}},
+		{ErrConflict, []string{"ConflictError"}, []string{"409"}},
+		{ErrTimeout, []string{"timeout", "Timeout", "deadline exceeded"}, []string{"408", "504"}},
+		{ErrTransient, []string{"connection refused", "connection reset", "broken pipe",
+			"no route to host", "EOF", "ServiceUnavailable", "temporarily unavailable"},
+			[]string{"500", "502", "503"}},
+	}
+)
+
+// classifyKind determines the ErrorKind of an error returned by the client
+func classifyKind(err error) ErrorKind {
+	if err == nil {
+		return ErrUnknown
+	}
+	if k := kindOf(err); k != ErrUnknown {
+		return k
+	}
+	if err == context.DeadlineExceeded {
+		return ErrTimeout
+	}
+	if nerr, ok := err.(net.Error); ok {
+		if nerr.Timeout() {
+			return ErrTimeout
+		}
+		return ErrTransient
+	}
+	msg := err.Error()
+	// The http code is authoritative when the backend reports one, messages
+	// are free text and can mention anything ("not found" in a 403)
+	if m := httpCodeRe.FindStringSubmatch(msg); m != nil {
+		return kindOfCode(m[1], msg)
+	}
+	for _, km := range kindMatchers {
+		for _, s := range km.matches {
+			if strings.Contains(msg, s) {
+				return km.kind
+			}
+		}
+	}
+	return ErrUnknown
+}
+
+// kindOfCode maps an http code to its ErrorKind.  A lost Create race comes
+// back as a 409 and is only told apart from other conflicts by its message
+func kindOfCode(code, msg string) ErrorKind {
+	for _, km := range kindMatchers {
+		for _, c := range km.codes {
+			if c != code {
+				continue
+			}
+			if km.kind == ErrConflict && strings.Contains(msg, "already exist") {
+				return ErrAlreadyExists
+			}
+			return km.kind
+		}
+	}
+	return ErrUnknown
+}
+
+// classify wraps err in a *BackendError.  Errors that are already classified
+// are returned unchanged
+func classify(op, name string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*BackendError); ok {
+		return err
+	}
+	return &BackendError{Kind: classifyKind(err), Op: op, Name: name, Err: err}
+}
+
+// timedOut replaces err with a timeout error when the request's deadline
+// expired while it was being handled
+func timedOut(ctxt context.Context, name string, err error) error {
+	if err == nil || ctxt.Err() != context.DeadlineExceeded {
+		return err
+	}
+	if IsTimeout(err) {
+		return err
+	}
+	op, _ := ctxt.Value(co.ReqName).(string)
+	return &BackendError{
+		Kind: ErrTimeout,
+		Op:   op,
+		Name: name,
+		Err:  fmt.Errorf("request deadline exceeded, the operation can be retried: %s", err),
+	}
+}
+
+// kindOf returns the ErrorKind of an already classified error, looking
+// through rollback errors to the step that failed
+func kindOf(err error) ErrorKind {
+	switch e := err.(type) {
+	case *BackendError:
+		return e.Kind
+	case *RollbackError:
+		return kindOf(e.Err)
+	}
+	return ErrUnknown
+}
+
+func IsNotFound(err error) bool {
+	return kindOf(err) == ErrNotFound
+}
+
+func IsAlreadyExists(err error) bool {
+	return kindOf(err) == ErrAlreadyExists
+}
+
+func IsUnauthorized(err error) bool {
+	return kindOf(err) == ErrUnauthorized
+}
+
+func IsConflict(err error) bool {
+	return kindOf(err) == ErrConflict
+}
+
+func IsTransient(err error) bool {
+	return kindOf(err) == ErrTransient
+}
+
+func IsTimeout(err error) bool {
+	return kindOf(err) == ErrTimeout
+}
@@ -0,0 +1,110 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	co "github.com/Datera/docker-driver/pkg/common"
+)
+
+// testContext returns a context carrying what the logging helpers expect
+func testContext() context.Context {
+	ctxt := context.WithValue(context.Background(), co.TraceId, "test")
+	return context.WithValue(ctxt, co.ReqName, "test")
+}
+
+// apiError builds an error the way the client reports a failed request, as
+// a pretty printed ApiErrorResponse
+func apiError(name string, http int, msg string) error {
+	return fmt.Errorf(`{
+ "name": "%s",
+ "code": 0,
+ "http": %d,
+ "message": "%s",
+ "debug": "",
+ "ts": "2019-04-11T19:23:51.517185+00:00",
+ "api_req_id": 5527,
+ "storage_node_uuid": "4d0e4b3c-3a7d-4a9e-9d5e-1f8ad1b2c3d4",
+ "storage_node_hostname": "sn-1",
+ "schema": "",
+ "errors": null
+}`, name, http, msg)
+}
+
+func TestClassifyKind(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want ErrorKind
+	}{
+		{"nil", nil, ErrUnknown},
+		{"not found", apiError("NotFoundError", 404, "The requested resource was not found"), ErrNotFound},
+		{"not found by code", apiError("", 404, ""), ErrNotFound},
+		{"client not found", errors.New("AppInstance docker-vol1 does not exist"), ErrNotFound},
+		// A 409 is refined by its message so lost Create races are told
+		// apart from other conflicts
+		{"already exists", apiError("ConflictError", 409, "App instance with name docker-vol1 already exists"), ErrAlreadyExists},
+		{"conflict", apiError("ConflictError", 409, "Cannot delete an online storage instance"), ErrConflict},
+		{"auth failed", apiError("AuthFailedError", 401, "Invalid username or password"), ErrUnauthorized},
+		{"permission denied", apiError("PermissionDeniedError", 403, "Permission denied"), ErrUnauthorized},
+		{"session expired", apiError("InvalidSessionKeyError", 401, "Invalid session key"), ErrUnauthorized},
+		// The code wins over whatever the message mentions
+		{"forbidden not found", apiError("PermissionDeniedError", 403, "Volume docker-vol1 not found for tenant /root"), ErrUnauthorized},
+		{"unauthorized not found", apiError("AuthFailedError", 401, "User not found"), ErrUnauthorized},
+		{"unavailable timeout", apiError("ServiceUnavailableError", 503, "Timeout waiting for storage node"), ErrTransient},
+		{"unmapped code", apiError("ValidationFailedError", 422, "Volume not found in template"), ErrUnknown},
+		{"gateway timeout", apiError("", 504, "Gateway Time-out"), ErrTimeout},
+		{"service unavailable", apiError("ServiceUnavailableError", 503, "Service is unavailable"), ErrTransient},
+		{"internal error", apiError("InternalError", 500, "Internal server error"), ErrTransient},
+		{"bad request", apiError("ValidationFailedError", 422, "Invalid value for replica_count"), ErrUnknown},
+		// The ACL calls format the ApiErrorResponse with %#v
+		{"go syntax", errors.New(`&dsdk.ApiErrorResponse{Name:"", Code:0, Http:503, Message:"Service is unavailable"}`), ErrTransient},
+		{"go syntax conflict", errors.New(`&dsdk.ApiErrorResponse{Name:"ConflictError", Code:0, Http:409, Message:"Initiator is in use"}`), ErrConflict},
+		{"deadline", context.DeadlineExceeded, ErrTimeout},
+		{"net timeout", &net.DNSError{Err: "i/o timeout", Name: "datera", IsTimeout: true}, ErrTimeout},
+		{"net error", &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("network is unreachable")}, ErrTransient},
+		{"connection refused", errors.New("dial tcp 172.16.0.10:7717: connect: connection refused"), ErrTransient},
+		{"eof", errors.New(`Post https://172.16.0.10:7717/v2.2/login: EOF`), ErrTransient},
+		{"classified", &BackendError{Kind: ErrConflict, Err: errors.New("not found")}, ErrConflict},
+		{"rollback", &RollbackError{Op: "Mount", Step: "login", Err: &BackendError{Kind: ErrNotFound}}, ErrNotFound},
+		{"unknown", errors.New("something went wrong"), ErrUnknown},
+	}
+	for _, tt := range tests {
+		if got := classifyKind(tt.err); got != tt.want {
+			t.Errorf("%s: classifyKind(%v) = %s, want %s", tt.name, tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestClassify(t *testing.T) {
+	if err := classify("GetVolume", "vol1", nil); err != nil {
+		t.Errorf("classify(nil) = %v, want nil", err)
+	}
+	be := &BackendError{Kind: ErrTransient, Op: "Login"}
+	if err := classify("GetVolume", "vol1", be); err != be {
+		t.Errorf("classify of a BackendError = %v, want it unchanged", err)
+	}
+	err := classify("GetVolume", "vol1", apiError("NotFoundError", 404, "not found"))
+	if !IsNotFound(err) {
+		t.Errorf("classify of a 404 = %v, want NotFound", err)
+	}
+	if be, ok := err.(*BackendError); !ok || be.Op != "GetVolume" || be.Name != "vol1" {
+		t.Errorf("classify = %#v, want a BackendError for GetVolume vol1", err)
+	}
+}
+
+func TestTimedOut(t *testing.T) {
+	ctxt, cancel := context.WithTimeout(testContext(), 0)
+	defer cancel()
+	<-ctxt.Done()
+	if err := timedOut(ctxt, "vol1", errors.New("mkfs failed")); !IsTimeout(err) {
+		t.Errorf("timedOut after the deadline = %v, want Timeout", err)
+	}
+	err := errors.New("mkfs failed")
+	if got := timedOut(testContext(), "vol1", err); got != err {
+		t.Errorf("timedOut before the deadline = %v, want %v", got, err)
+	}
+}
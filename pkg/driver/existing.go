@@ -0,0 +1,223 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	co "github.com/Datera/docker-driver/pkg/common"
+
+	dc "github.com/Datera/datera-csi/pkg/client"
+)
+
+const (
+	qosIops = "total_iops_max"
+	qosBW   = "total_bandwidth_max"
+)
+
+// optDiff is a single difference between a Create request and an existing
+// volume.  Safe differences can be applied in place
+type optDiff struct {
+	Opt       string
+	Requested string
+	Existing  string
+	Safe      bool
+}
+
+func (o optDiff) String() string {
+	return fmt.Sprintf("%s: requested %s, existing %s", o.Opt, o.Requested, o.Existing)
+}
+
+// diffExisting compares the options explicitly given in a Create request with
+// the volume that already exists.  Options that weren't specified are ignored
+// so implicit creates from `docker run` never conflict
+func diffExisting(vol *dc.Volume, md dc.VolMetadata, volOpts map[string]string) []optDiff {
+	req := parseVolOpts(volOpts)
+	diffs := []optDiff{}
+	add := func(opt string, r, e interface{}, safe bool) {
+		diffs = append(diffs, optDiff{
+			Opt:       opt,
+			Requested: fmt.Sprintf("%v", r),
+			Existing:  fmt.Sprintf("%v", e),
+			Safe:      safe,
+		})
+	}
+	if _, ok := volOpts[OptSize]; ok && req.Size != vol.Size {
+		// Volumes can only grow
+		add(OptSize, req.Size, vol.Size, req.Size > vol.Size)
+	}
+	if _, ok := volOpts[OptReplica]; ok && req.Replica != vol.Replicas {
+		add(OptReplica, req.Replica, vol.Replicas, false)
+	}
+	if _, ok := volOpts[OptPlacement]; ok && req.PlacementMode != vol.PlacementMode {
+		add(OptPlacement, req.PlacementMode, vol.PlacementMode, false)
+	}
+	if _, ok := volOpts[OptTemplate]; ok && req.Template != vol.Template {
+		add(OptTemplate, req.Template, vol.Template, false)
+	}
+	if _, ok := volOpts[OptMaxiops]; ok && req.TotalIopsMax != vol.QoS[qosIops] {
+		add(OptMaxiops, req.TotalIopsMax, vol.QoS[qosIops], true)
+	}
+	if _, ok := volOpts[OptMaxbw]; ok && req.TotalBandwidthMax != vol.QoS[qosBW] {
+		add(OptMaxbw, req.TotalBandwidthMax, vol.QoS[qosBW], true)
+	}
+	if fs, ok := volOpts[OptFstype]; ok && fs != md[OptFstype] {
+		add(OptFstype, fs, md[OptFstype], false)
+	}
+	access := md[OptAccessType]
+	if access == "" {
+		access = AccessFilesystem
+	}
+	if a, ok := volOpts[OptAccessType]; ok && a != access {
+		add(OptAccessType, a, access, false)
+	}
+	if o, ok := volOpts[OptMkfsOpts]; ok && o != md[OptMkfsOpts] {
+		add(OptMkfsOpts, o, md[OptMkfsOpts], false)
+	}
+	// The confirmation is only kept as part of a force policy
+	policy := md[OptFormatPol]
+	if policy == "" {
+		policy = FormatIfBlank
+	}
+	if p, ok := volOpts[OptFormatPol]; ok && p != policy {
+		add(OptFormatPol, p, policy, false)
+	}
+	confirm := ""
+	if policy == FormatForce {
+		confirm = vol.Name
+	}
+	if c, ok := volOpts[OptFormatConf]; ok && c != confirm {
+		add(OptFormatConf, c, confirm, false)
+	}
+	// Ownership is only applied when the filesystem is created, or on
+	// every Mount with ownerOnMount, so changing it here would not stick
+	for _, k := range []string{OptUid, OptGid} {
+		if v, ok := volOpts[k]; ok {
+			r, _ := strconv.Atoi(v)
+			if e, err := strconv.Atoi(md[k]); err != nil || r != e {
+				add(k, v, md[k], false)
+			}
+		}
+	}
+	if v, ok := volOpts[OptMode]; ok {
+		r, _ := strconv.ParseUint(v, 8, 32)
+		if e, err := strconv.ParseUint(md[OptMode], 8, 32); err != nil || r != e {
+			add(OptMode, v, md[OptMode], false)
+		}
+	}
+	if enc, ok := volOpts[OptEncrypted]; ok {
+		if e, _ := strconv.ParseBool(enc); e != isEncrypted(md) {
+			add(OptEncrypted, e, isEncrypted(md), false)
+		}
+	}
+	// Access changes go through `volume set-readonly` and `volume release`
+	// so a create can't flip them under running containers
+	if ro, ok := volOpts[OptReadOnly]; ok {
+		if r, _ := strconv.ParseBool(ro); r != isReadOnly(md) {
+			add(OptReadOnly, r, isReadOnly(md), false)
+		}
+	}
+	// Mount options are applied on every Mount so they can be changed
+	if o, ok := volOpts[OptMountOpts]; ok && o != md[OptMountOpts] {
+		add(OptMountOpts, o, md[OptMountOpts], true)
+	}
+	fsck := md[OptFsckPolicy]
+	if fsck == "" {
+		fsck = FsckRepair
+	}
+	if p, ok := volOpts[OptFsckPolicy]; ok && p != fsck {
+		add(OptFsckPolicy, p, fsck, true)
+	}
+	if t, ok := volOpts[OptTrim]; ok {
+		trim, _ := strconv.ParseBool(t)
+		existing, err := strconv.ParseBool(md[OptTrim])
+		if err != nil {
+			existing = true
+		}
+		if trim != existing {
+			add(OptTrim, trim, existing, true)
+		}
+	}
+	if t, ok := volOpts[OptTtl]; ok && t != md[OptTtl] {
+		add(OptTtl, t, md[OptTtl], true)
+	}
+	if f, ok := volOpts[OptForceAttach]; ok {
+		force, _ := strconv.ParseBool(f)
+		existing, _ := strconv.ParseBool(md[OptForceAttach])
+		if force != existing {
+			add(OptForceAttach, force, existing, false)
+		}
+	}
+	return diffs
+}
+
+// checkExisting applies the configured ExistingVolumePolicy to a Create
+// request for a volume that already exists
+func (d *DateraDriver) checkExisting(ctxt context.Context, vol *dc.Volume, volOpts map[string]string) error {
+	policy := d.Config.ExistingVolumePolicy
+	if policy == ExistingIgnore {
+		return nil
+	}
+	md, err := getMetadata(vol)
+	if err != nil {
+		return err
+	}
+	diffs := diffExisting(vol, md, volOpts)
+	if len(diffs) == 0 {
+		return nil
+	}
+	co.Debugf(ctxt, "Existing volume %s differs from request: %#v", vol.Name, diffs)
+	unsafe := []string{}
+	for _, diff := range diffs {
+		if policy == ExistingVerify || !diff.Safe {
+			unsafe = append(unsafe, diff.String())
+		}
+	}
+	if len(unsafe) != 0 {
+		return fmt.Errorf("Volume %s already exists with different options [%s]",
+			vol.Name, strings.Join(unsafe, "; "))
+	}
+
+	// Only safe changes are left and the policy allows applying them
+	req := parseVolOpts(volOpts)
+	qos := false
+	for _, diff := range diffs {
+		switch diff.Opt {
+		case OptSize:
+			co.Infof(ctxt, "Growing volume %s from %d to %d GiB", vol.Name, vol.Size, req.Size)
+			if err = vol.Resize(req.Size); err != nil {
+				return classify("Resize", vol.Name, err)
+			}
+		case OptMaxiops, OptMaxbw:
+			qos = true
+		case OptFsckPolicy, OptTrim, OptTtl:
+			if _, err = vol.SetMetadata(&dc.VolMetadata{diff.Opt: diff.Requested}); err != nil {
+				return classify("SetMetadata", vol.Name, err)
+			}
+		case OptMountOpts:
+			co.Infof(ctxt, "Updating mount options of volume %s to %s", vol.Name, volOpts[OptMountOpts])
+			if _, err = vol.SetMetadata(&dc.VolMetadata{OptMountOpts: volOpts[OptMountOpts]}); err != nil {
+				return classify("SetMetadata", vol.Name, err)
+			}
+		}
+	}
+	if qos {
+		pOpts := &dc.VolOpts{
+			TotalIopsMax:      vol.QoS[qosIops],
+			TotalBandwidthMax: vol.QoS[qosBW],
+		}
+		if _, ok := volOpts[OptMaxiops]; ok {
+			pOpts.TotalIopsMax = req.TotalIopsMax
+		}
+		if _, ok := volOpts[OptMaxbw]; ok {
+			pOpts.TotalBandwidthMax = req.TotalBandwidthMax
+		}
+		co.Infof(ctxt, "Updating QoS of volume %s to maxIops %d, maxBW %d",
+			vol.Name, pOpts.TotalIopsMax, pOpts.TotalBandwidthMax)
+		if err = vol.SetPerformancePolicy(pOpts); err != nil {
+			return classify("SetPerformancePolicy", vol.Name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package driver
+
+import (
+	"reflect"
+	"testing"
+
+	dc "github.com/Datera/datera-csi/pkg/client"
+)
+
+func TestDiffExisting(t *testing.T) {
+	vol := &dc.Volume{
+		Name:          "vol1",
+		Size:          16,
+		Replicas:      3,
+		PlacementMode: "hybrid",
+		QoS:           map[string]int{qosIops: 1000, qosBW: 0},
+	}
+	md := dc.VolMetadata{
+		OptFstype:     "ext4",
+		OptAccessType: AccessFilesystem,
+		OptMountOpts:  "noatime",
+		OptTtl:        "72h",
+		OptFormatPol:  FormatIfBlank,
+		OptUid:        "1000",
+		OptMode:       "0750",
+	}
+	tests := []struct {
+		name string
+		opts map[string]string
+		want []optDiff
+	}{
+		{"nothing requested", map[string]string{}, []optDiff{}},
+		{"same options", map[string]string{OptSize: "16", OptReplica: "3", OptFstype: "ext4", OptMaxiops: "1000",
+			OptAccessType: AccessFilesystem, OptFsckPolicy: FsckRepair, OptTrim: "true", OptForceAttach: "false",
+			OptReadOnly: "false", OptEncrypted: "false"}, []optDiff{}},
+		{"grow", map[string]string{OptSize: "32"}, []optDiff{{OptSize, "32", "16", true}}},
+		{"shrink", map[string]string{OptSize: "8"}, []optDiff{{OptSize, "8", "16", false}}},
+		{"replicas", map[string]string{OptReplica: "2"}, []optDiff{{OptReplica, "2", "3", false}}},
+		{"placement", map[string]string{OptPlacement: "all_flash"}, []optDiff{{OptPlacement, "all_flash", "hybrid", false}}},
+		{"qos", map[string]string{OptMaxiops: "500", OptMaxbw: "100"},
+			[]optDiff{{OptMaxiops, "500", "1000", true}, {OptMaxbw, "100", "0", true}}},
+		{"fs", map[string]string{OptFstype: "xfs"}, []optDiff{{OptFstype, "xfs", "ext4", false}}},
+		{"block", map[string]string{OptAccessType: AccessBlock}, []optDiff{{OptAccessType, AccessBlock, AccessFilesystem, false}}},
+		{"same ownership", map[string]string{OptUid: "1000", OptMode: "750", OptFormatPol: FormatIfBlank}, []optDiff{}},
+		{"format policy", map[string]string{OptFormatPol: FormatForce, OptFormatConf: "vol1"},
+			[]optDiff{{OptFormatPol, FormatForce, FormatIfBlank, false}, {OptFormatConf, "vol1", "", false}}},
+		{"uid", map[string]string{OptUid: "0"}, []optDiff{{OptUid, "0", "1000", false}}},
+		{"gid", map[string]string{OptGid: "100"}, []optDiff{{OptGid, "100", "", false}}},
+		{"mode", map[string]string{OptMode: "2770"}, []optDiff{{OptMode, "2770", "0750", false}}},
+		{"encrypt", map[string]string{OptEncrypted: "true"}, []optDiff{{OptEncrypted, "true", "false", false}}},
+		{"read-only", map[string]string{OptReadOnly: "true"}, []optDiff{{OptReadOnly, "true", "false", false}}},
+		{"mount opts", map[string]string{OptMountOpts: "noatime,discard"},
+			[]optDiff{{OptMountOpts, "noatime,discard", "noatime", true}}},
+		{"fsck", map[string]string{OptFsckPolicy: FsckNever}, []optDiff{{OptFsckPolicy, FsckNever, FsckRepair, true}}},
+		{"trim", map[string]string{OptTrim: "false"}, []optDiff{{OptTrim, "false", "true", true}}},
+		{"force attach", map[string]string{OptForceAttach: "true"}, []optDiff{{OptForceAttach, "true", "false", false}}},
+		{"ttl", map[string]string{OptTtl: "24h"}, []optDiff{{OptTtl, "24h", "72h", true}}},
+	}
+	for _, tt := range tests {
+		if got := diffExisting(vol, md, tt.opts); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: diffExisting(%v) = %v, want %v", tt.name, tt.opts, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,272 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	co "github.com/Datera/docker-driver/pkg/common"
+
+	dc "github.com/Datera/datera-csi/pkg/client"
+	dsdk "github.com/Datera/go-sdk/pkg/dsdk"
+)
+
+// initiatorId returns the IQN of an ACL or session initiator
+func initiatorId(i *dsdk.Initiator) string {
+	if i.Id != "" {
+		return i.Id
+	}
+	return i.Path[strings.LastIndex(i.Path, "/")+1:]
+}
+
+// aclPolicy fetches the current ACL of a storage instance
+func (d *DateraDriver) aclPolicy(ctxt context.Context, name string, si *dsdk.StorageInstance) (*dsdk.AclPolicy, error) {
+	var acl *dsdk.AclPolicy
+	err := d.retry(ctxt, "GetAclPolicy", func() error {
+		var apierr *dsdk.ApiErrorResponse
+		var err error
+		acl, apierr, err = si.AclPolicy.Get(&dsdk.AclPolicyGetRequest{Ctxt: ctxt})
+		if err == nil && apierr != nil {
+			err = fmt.Errorf("%#v", apierr)
+		}
+		return classify("GetAclPolicy", name, err)
+	})
+	return acl, err
+}
+
+// initiators returns the IQNs in the volume's ACLs and those logged in to
+// it
+func (d *DateraDriver) initiators(ctxt context.Context, vol *dc.Volume) (acl, sessions map[string]bool, err error) {
+	acl, sessions = map[string]bool{}, map[string]bool{}
+	if vol.Ai == nil {
+		return acl, sessions, nil
+	}
+	for _, si := range vol.Ai.StorageInstances {
+		for _, i := range si.ActiveInitiators {
+			sessions[initiatorId(i)] = true
+		}
+		if si.AclPolicy == nil {
+			continue
+		}
+		policy, err := d.aclPolicy(ctxt, vol.Name, si)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, i := range policy.Initiators {
+			acl[initiatorId(i)] = true
+		}
+	}
+	return acl, sessions, nil
+}
+
+// remoteInitiators returns the IQNs other than this host's that are in the
+// volume's ACL or logged in to it
+func (d *DateraDriver) remoteInitiators(ctxt context.Context, vol *dc.Volume, init *dc.Initiator) ([]string, error) {
+	acl, sessions, err := d.initiators(ctxt, vol)
+	if err != nil {
+		return nil, err
+	}
+	for iqn := range sessions {
+		acl[iqn] = true
+	}
+	delete(acl, init.Iqn)
+	iqns := []string{}
+	for iqn := range acl {
+		iqns = append(iqns, iqn)
+	}
+	sort.Strings(iqns)
+	return iqns, nil
+}
+
+// removeInitiators removes the given IQNs from every ACL of the volume,
+// which ends their sessions
+func (d *DateraDriver) removeInitiators(ctxt context.Context, vol *dc.Volume, iqns []string) error {
+	if vol.Ai == nil {
+		return nil
+	}
+	drop := map[string]bool{}
+	for _, iqn := range iqns {
+		drop[iqn] = true
+	}
+	for _, si := range vol.Ai.StorageInstances {
+		if si.AclPolicy == nil {
+			continue
+		}
+		acl, err := d.aclPolicy(ctxt, vol.Name, si)
+		if err != nil {
+			return err
+		}
+		keep := []*dsdk.Initiator{}
+		for _, i := range acl.Initiators {
+			if !drop[initiatorId(i)] {
+				keep = append(keep, i)
+			}
+		}
+		if len(keep) == len(acl.Initiators) {
+			continue
+		}
+		err = d.retry(ctxt, "SetAclPolicy", func() error {
+			_, apierr, err := si.AclPolicy.Set(&dsdk.AclPolicySetRequest{Ctxt: ctxt, Initiators: keep})
+			if err == nil && apierr != nil {
+				err = fmt.Errorf("%#v", apierr)
+			}
+			return classify("SetAclPolicy", vol.Name, err)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// describeInitiator names the host holding a lease for iqn if there is one
+func describeInitiator(iqn string, leases map[string]lease) string {
+	if l, ok := leases[iqn]; ok {
+		return fmt.Sprintf("%s (%s)", l.Host, iqn)
+	}
+	return iqn
+}
+
+// fenceCheck runs the configured fence command to confirm a host that
+// holds a volume is down.  The command is run with the host's IQN and, when
+// a lease names it, its hostname appended and must exit 0 to confirm
+func (d *DateraDriver) fenceCheck(ctxt context.Context, iqn string, leases map[string]lease) bool {
+	args := append(append([]string{}, d.Config.FenceCommand[1:]...), iqn)
+	if l, ok := leases[iqn]; ok {
+		args = append(args, l.Host)
+	}
+	out, err := co.ExecC(ctxt, d.Config.FenceCommand[0], args...).CombinedOutput()
+	if err != nil {
+		co.Infof(ctxt, "Fence check of %s did not pass: %s: %s", iqn, err, strings.TrimSpace(string(out)))
+		return false
+	}
+	co.Infof(ctxt, "Fence check confirmed %s is down", describeInitiator(iqn, leases))
+	return true
+}
+
+// fence refuses to attach a volume that another host still has attached.
+// Hosts whose lease expired more than the grace period ago, or that the
+// fence command confirms are down when auto_release is on, are removed from
+// the ACL.  With the volume's forceAttach option every other host is, and
+// the option is cleared.  Every takeover is audited
+func (d *DateraDriver) fence(ctxt context.Context, vol *dc.Volume, md dc.VolMetadata, init *dc.Initiator) error {
+	if !d.Config.Fencing {
+		return nil
+	}
+	force, _ := strconv.ParseBool(md[OptForceAttach])
+	others, err := d.remoteInitiators(ctxt, vol, init)
+	if err != nil {
+		return err
+	}
+	if len(others) == 0 {
+		return d.clearForce(ctxt, vol, force)
+	}
+	leases := leasesOf(ctxt, md)
+	now := time.Now()
+	stale, live := []string{}, []string{}
+	for _, iqn := range others {
+		// Without a lease there's no telling whether the host is alive
+		if l, ok := leases[iqn]; ok && d.leaseExpired(l, now) {
+			stale = append(stale, iqn)
+		} else if d.Config.AutoRelease && d.fenceCheck(ctxt, iqn, leases) {
+			stale = append(stale, iqn)
+		} else {
+			live = append(live, describeInitiator(iqn, leases))
+		}
+	}
+	if len(live) != 0 && !force {
+		return &BackendError{
+			Kind: ErrConflict,
+			Op:   "Mount",
+			Name: vol.Name,
+			Err: fmt.Errorf("volume is attached to other hosts [%s], unmount it there or release it with --force if they are down",
+				strings.Join(live, ", ")),
+		}
+	}
+	from := stale
+	if force {
+		from = others
+	}
+	if err = d.removeInitiators(ctxt, vol, from); err != nil {
+		return err
+	}
+	if err = d.auditTakeover(ctxt, vol, "mount", from, len(live) != 0); err != nil {
+		return err
+	}
+	return d.clearForce(ctxt, vol, force)
+}
+
+// clearForce clears the forceAttach option once a Mount has used it.  Like
+// formatPolicy=force it only applies once, a volume that kept it would never
+// be fenced
+func (d *DateraDriver) clearForce(ctxt context.Context, vol *dc.Volume, force bool) error {
+	if !force {
+		return nil
+	}
+	co.Infof(ctxt, "Clearing %s of volume %s", OptForceAttach, vol.Name)
+	return d.retry(ctxt, "SetMetadata", func() error {
+		_, err := vol.SetMetadata(&dc.VolMetadata{OptForceAttach: ""})
+		return classify("SetMetadata", vol.Name, err)
+	})
+}
+
+// Release removes other hosts from a volume's ACL so it can be mounted
+// elsewhere, e.g. after the host holding it died.  hostname limits the
+// release to one host, given by its hostname or IQN.  Unless force is set
+// only hosts whose lease expired more than the grace period ago are
+// released.  It returns the IQNs released
+func (d *DateraDriver) Release(name, hostname string, force bool) (_ []string, err error) {
+	ctxt, cancel := d.initFunc("Release")
+	defer cancel()
+	defer func() { err = timedOut(ctxt, name, err) }()
+	d.Mutex.Lock()
+	defer d.Mutex.Unlock()
+	vol, err := d.getVolume(ctxt, name, false, true)
+	if err != nil {
+		return nil, err
+	}
+	md, err := getMetadata(vol)
+	if err != nil {
+		return nil, err
+	}
+	init, err := d.getInitiator(ctxt)
+	if err != nil {
+		return nil, err
+	}
+	others, err := d.remoteInitiators(ctxt, vol, init)
+	if err != nil {
+		return nil, err
+	}
+	leases := leasesOf(ctxt, md)
+	now := time.Now()
+	from := []string{}
+	for _, iqn := range others {
+		l, ok := leases[iqn]
+		if hostname != "" && iqn != hostname && !(ok && l.Host == hostname) {
+			continue
+		}
+		if !force {
+			if !ok {
+				return nil, fmt.Errorf("%s holds no lease on volume %s, release it with --force if it is down",
+					iqn, name)
+			} else if !d.leaseExpired(l, now) {
+				return nil, fmt.Errorf("Lease of %s on volume %s expires at %s (grace %s), release it with --force if it is down",
+					describeInitiator(iqn, leases), name, l.Expiry.Format(time.RFC3339), d.Config.Lease.Grace)
+			}
+		}
+		from = append(from, iqn)
+	}
+	if len(from) == 0 {
+		if hostname != "" {
+			return nil, fmt.Errorf("Volume %s is not attached to %s", name, hostname)
+		}
+		return from, nil
+	}
+	if err = d.removeInitiators(ctxt, vol, from); err != nil {
+		return nil, err
+	}
+	return from, d.auditTakeover(ctxt, vol, "release", from, force)
+}
@@ -0,0 +1,49 @@
+package driver
+
+import (
+	"reflect"
+	"testing"
+
+	dc "github.com/Datera/datera-csi/pkg/client"
+	dsdk "github.com/Datera/go-sdk/pkg/dsdk"
+)
+
+func TestRemoveInitiatorsNoAppInstance(t *testing.T) {
+	d := &DateraDriver{}
+	vol := &dc.Volume{Name: "vol1"}
+	if err := d.removeInitiators(testContext(), vol, []string{"iqn.1993-08.org.debian:01:remote"}); err != nil {
+		t.Errorf("removeInitiators without an app instance = %v, want nil", err)
+	}
+}
+
+func TestInitiatorsSessions(t *testing.T) {
+	local := "iqn.1993-08.org.debian:01:local"
+	remote := "iqn.1993-08.org.debian:01:remote"
+	vol := &dc.Volume{Name: "vol1", Ai: &dsdk.AppInstance{StorageInstances: []*dsdk.StorageInstance{
+		{ActiveInitiators: []*dsdk.Initiator{{Id: local}}},
+		{ActiveInitiators: []*dsdk.Initiator{{Path: "/initiators/" + remote}}},
+	}}}
+	d := &DateraDriver{}
+	acl, sessions, err := d.initiators(testContext(), vol)
+	if err != nil {
+		t.Fatalf("initiators = %v", err)
+	}
+	if len(acl) != 0 {
+		t.Errorf("acl = %v, want none without ACL policies", acl)
+	}
+	if !reflect.DeepEqual(sessions, map[string]bool{local: true, remote: true}) {
+		t.Errorf("sessions = %v, want %s and %s", sessions, local, remote)
+	}
+	iqns, err := d.remoteInitiators(testContext(), vol, &dc.Initiator{Iqn: local})
+	if err != nil || !reflect.DeepEqual(iqns, []string{remote}) {
+		t.Errorf("remoteInitiators = %v, %v, want [%s]", iqns, err, remote)
+	}
+}
+
+func TestInitiatorsNoAppInstance(t *testing.T) {
+	d := &DateraDriver{}
+	acl, sessions, err := d.initiators(testContext(), &dc.Volume{Name: "vol1"})
+	if err != nil || len(acl) != 0 || len(sessions) != 0 {
+		t.Errorf("initiators without an app instance = %v, %v, %v, want nothing", acl, sessions, err)
+	}
+}
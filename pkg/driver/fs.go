@@ -0,0 +1,380 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+
+	co "github.com/Datera/docker-driver/pkg/common"
+
+	dc "github.com/Datera/datera-csi/pkg/client"
+)
+
+const (
+	// Format policies, see OptFormatPol
+	FormatNever   = "never"
+	FormatIfBlank = "ifBlank"
+	FormatForce   = "force"
+
+	// Fsck policies, see OptFsckPolicy
+	FsckNever  = "never"
+	FsckCheck  = "check"
+	FsckRepair = "repair"
+
+	// Metadata key set to "true" when a volume was last unmounted cleanly
+	// and "false" while it is mounted
+	MdCleanUnmount = "cleanUnmount"
+)
+
+// fsInfo describes how the driver creates, grows and checks a supported
+// filesystem.  grow, check and repair return the command to run, grow
+// operates on the mounted filesystem while check (read-only) and repair
+// (fixes what can be fixed safely) operate on the unmounted device.  A nil
+// repair means mounting the filesystem repairs it by replaying its log, so
+// it is only checked if the mount fails.  repairedCodes are exit codes of
+// repair meaning errors were fixed
+type fsInfo struct {
+	forceFlag     string
+	mkfsArgs      []string
+	grow          func(dev, mountpoint string) []string
+	check         func(dev string) []string
+	repair        func(dev string) []string
+	repairedCodes []int
+}
+
+var filesystems = map[string]fsInfo{
+	"ext4": {
+		forceFlag: "-F",
+		grow:      func(dev, mp string) []string { return []string{"resize2fs", dev} },
+		check:     func(dev string) []string { return []string{"e2fsck", "-n", dev} },
+		repair:    func(dev string) []string { return []string{"e2fsck", "-p", dev} },
+		// 1: errors corrected, 2: errors corrected, reboot advised
+		repairedCodes: []int{1, 2},
+	},
+	"xfs": {
+		forceFlag: "-f",
+		// Datera volumes are thin provisioned, discarding the whole device
+		// at mkfs time only slows down the format
+		mkfsArgs: []string{"-K"},
+		grow:     func(dev, mp string) []string { return []string{"xfs_growfs", mp} },
+		// xfs_repair ignores a dirty log and reports the inconsistencies
+		// replaying it would fix, so after a crash it is only meaningful
+		// once mounting failed.  Anything beyond the log replay needs a
+		// manual xfs_repair
+		check: func(dev string) []string { return []string{"xfs_repair", "-n", dev} },
+	},
+	"btrfs": {
+		forceFlag: "-f",
+		grow:      func(dev, mp string) []string { return []string{"btrfs", "filesystem", "resize", "max", mp} },
+		check:     func(dev string) []string { return []string{"btrfs", "check", "--readonly", dev} },
+		// btrfs check --repair isn't safe to run unattended
+		repair: func(dev string) []string { return []string{"btrfs", "check", "--readonly", dev} },
+	},
+}
+
+// checkFsType verifies fs is a supported filesystem
+func checkFsType(fs string) error {
+	if _, ok := filesystems[fs]; ok {
+		return nil
+	}
+	supported := []string{}
+	for k := range filesystems {
+		supported = append(supported, k)
+	}
+	sort.Strings(supported)
+	return fmt.Errorf("Unsupported %s %s, must be one of %s", OptFstype, fs, strings.Join(supported, ", "))
+}
+
+// run executes a host command, returning its combined output and an error
+// that includes the output if the command failed
+func run(ctxt context.Context, cmd []string) (string, error) {
+	out, err := co.ExecC(ctxt, cmd[0], cmd[1:]...).CombinedOutput()
+	sout := strings.TrimSpace(string(out))
+	if err != nil {
+		return sout, fmt.Errorf("%s failed: %s: %s", strings.Join(cmd, " "), err, sout)
+	}
+	return sout, nil
+}
+
+// probeFS returns the filesystem type found on dev, or "" if the device is
+// blank.  Any failure to probe is returned as an error so a device is never
+// formatted just because it couldn't be read
+func probeFS(ctxt context.Context, dev string) (string, error) {
+	out, err := co.ExecC(ctxt, "blkid", "-p", "-o", "value", "-s", "TYPE", dev).Output()
+	if eerr, ok := err.(*exec.ExitError); ok && eerr.ExitCode() == 2 {
+		// blkid exits with 2 when no known signature was found
+		return "", nil
+	} else if err != nil {
+		return "", fmt.Errorf("Could not probe %s for a filesystem: %s", dev, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// splitMkfsOpts splits the mkfsOpts volume option into mkfs arguments
+func splitMkfsOpts(s string) []string {
+	return strings.Fields(s)
+}
+
+// splitMountOpts splits the mountOpts volume option into mount options
+func splitMountOpts(s string) []string {
+	opts := []string{}
+	for _, o := range strings.Split(s, ",") {
+		if o = strings.TrimSpace(o); o != "" {
+			opts = append(opts, o)
+		}
+	}
+	return opts
+}
+
+func allowed(s string, allow []string) bool {
+	for _, a := range allow {
+		if s == a {
+			return true
+		}
+	}
+	return false
+}
+
+// checkMkfsOpts verifies every flag in args is allowed by the config.
+// Arguments that aren't flags are values for the preceding flag
+func checkMkfsOpts(args []string, conf *Config) error {
+	for _, a := range args {
+		if strings.HasPrefix(a, "-") && !allowed(a, conf.AllowedMkfsOpts) {
+			return fmt.Errorf("%s argument %s is not allowed", OptMkfsOpts, a)
+		}
+	}
+	return nil
+}
+
+// checkMountOpts verifies every mount option is allowed by the config
+func checkMountOpts(opts []string, conf *Config) error {
+	for _, o := range opts {
+		if !allowed(strings.SplitN(o, "=", 2)[0], conf.AllowedMountOpts) {
+			return fmt.Errorf("%s option %s is not allowed", OptMountOpts, o)
+		}
+	}
+	return nil
+}
+
+// isMounted reports whether path is a mountpoint
+func isMounted(path string) (bool, error) {
+	b, err := ioutil.ReadFile("/proc/mounts")
+	if err != nil {
+		return false, err
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if f := strings.Fields(line); len(f) > 1 && f[1] == path {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// unmountPath unmounts path if something is mounted there
+func unmountPath(ctxt context.Context, path string) error {
+	mounted, err := isMounted(path)
+	if err != nil || !mounted {
+		return err
+	}
+	_, err = run(ctxt, []string{"umount", path})
+	return err
+}
+
+// mkfs creates a filesystem of type fs on dev with the extra arguments in
+// opts.  force overwrites any existing signature
+func mkfs(ctxt context.Context, dev, fs string, force bool, opts []string) error {
+	info, ok := filesystems[fs]
+	if !ok {
+		return checkFsType(fs)
+	}
+	cmd := []string{"mkfs." + fs}
+	if force {
+		cmd = append(cmd, info.forceFlag)
+	}
+	cmd = append(cmd, info.mkfsArgs...)
+	cmd = append(cmd, opts...)
+	cmd = append(cmd, dev)
+	_, err := run(ctxt, cmd)
+	return err
+}
+
+// growFS expands the filesystem mounted at mountpoint to fill its device,
+// picking up any resize of the volume since it was formatted
+func growFS(ctxt context.Context, dev, mountpoint, fs string) error {
+	info, ok := filesystems[fs]
+	if !ok {
+		return checkFsType(fs)
+	}
+	_, err := run(ctxt, info.grow(dev, mountpoint))
+	return err
+}
+
+// checkFS checks the filesystem on dev for consistency.  When repair is set
+// errors that can be fixed automatically are, otherwise the check is
+// read-only.  An error including the tool's output is returned if the
+// filesystem is left inconsistent
+func checkFS(ctxt context.Context, dev, fs string, repair bool) error {
+	info, ok := filesystems[fs]
+	if !ok {
+		return checkFsType(fs)
+	}
+	cmd := info.check(dev)
+	if repair && info.repair != nil {
+		cmd = info.repair(dev)
+	}
+	out, err := co.ExecC(ctxt, cmd[0], cmd[1:]...).CombinedOutput()
+	if err == nil {
+		return nil
+	}
+	if eerr, ok := err.(*exec.ExitError); ok && repair {
+		for _, c := range info.repairedCodes {
+			if eerr.ExitCode() == c {
+				co.Warningf(ctxt, "Repaired filesystem errors on %s: %s", dev, strings.TrimSpace(string(out)))
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("Filesystem check of %s failed, manual repair needed. %s: %s: %s",
+		dev, strings.Join(cmd, " "), err, strings.TrimSpace(string(out)))
+}
+
+// fsckVolume checks the filesystem of a volume that wasn't cleanly unmounted
+// according to its fsck policy.  Read-only volumes are never repaired
+func fsckVolume(ctxt context.Context, vol *dc.Volume, md dc.VolMetadata, fs string, ro bool) error {
+	policy := md[OptFsckPolicy]
+	if policy == "" {
+		policy = FsckRepair
+	}
+	if policy == FsckNever {
+		co.Warningf(ctxt, "Volume %s was not cleanly unmounted, skipping filesystem check", vol.Name)
+		return nil
+	}
+	if policy == FsckRepair && filesystems[fs].repair == nil {
+		co.Infof(ctxt, "Volume %s was not cleanly unmounted, mounting it replays the %s log", vol.Name, fs)
+		return nil
+	}
+	repair := policy == FsckRepair && !ro
+	co.Infof(ctxt, "Volume %s was not cleanly unmounted, checking %s filesystem on %s (repair: %t)",
+		vol.Name, fs, vol.DevicePath, repair)
+	return checkFS(ctxt, vol.DevicePath, fs, repair)
+}
+
+// diagnoseMount adds the outcome of a read-only check to the error of a
+// volume that failed to mount after an unclean unmount, when the check was
+// left to the mount by fsckVolume
+func diagnoseMount(ctxt context.Context, vol *dc.Volume, md dc.VolMetadata, fs string, merr error) error {
+	policy := md[OptFsckPolicy]
+	if policy == "" {
+		policy = FsckRepair
+	}
+	if policy != FsckRepair || filesystems[fs].repair != nil {
+		return merr
+	}
+	co.Warningf(ctxt, "Volume %s failed to mount after an unclean unmount, checking %s filesystem on %s",
+		vol.Name, fs, vol.DevicePath)
+	if err := checkFS(ctxt, vol.DevicePath, fs, false); err != nil {
+		return fmt.Errorf("%s. %s", merr, err)
+	}
+	return merr
+}
+
+// checkFormatted verifies the volume's device already holds the expected
+// filesystem without writing to it
+func checkFormatted(ctxt context.Context, vol *dc.Volume, fs string) error {
+	found, err := probeFS(ctxt, vol.DevicePath)
+	if err != nil {
+		return err
+	}
+	if found == "" {
+		return fmt.Errorf("Volume %s is read-only and has no filesystem", vol.Name)
+	} else if found != fs {
+		return fmt.Errorf("Refusing to mount volume %s, device %s has a %s filesystem but %s was expected",
+			vol.Name, vol.DevicePath, found, fs)
+	}
+	return nil
+}
+
+// formatVolume applies the volume's format policy to its attached device.
+// Only a blank device is formatted unless the policy is force, and a device
+// holding a different filesystem than the one recorded at Create is refused.
+// It reports whether the device was formatted
+func formatVolume(ctxt context.Context, vol *dc.Volume, md dc.VolMetadata, fs string, opts []string) (bool, error) {
+	dev := vol.DevicePath
+	policy := md[OptFormatPol]
+	if policy == "" {
+		policy = FormatIfBlank
+	}
+	if policy == FormatForce {
+		co.Warningf(ctxt, "Force formatting volume %s device %s as %s", vol.Name, dev, fs)
+		if err := mkfs(ctxt, dev, fs, true, opts); err != nil {
+			return false, err
+		}
+		// A forced format only happens once, afterwards the volume is
+		// treated like any other
+		_, err := vol.SetMetadata(&dc.VolMetadata{OptFormatPol: FormatIfBlank})
+		return true, classify("SetMetadata", vol.Name, err)
+	}
+	found, err := probeFS(ctxt, dev)
+	if err != nil {
+		return false, err
+	}
+	switch {
+	case found == fs:
+		co.Debugf(ctxt, "Device %s already has a %s filesystem", dev, fs)
+		return false, nil
+	case found != "":
+		return false, fmt.Errorf("Refusing to mount volume %s, device %s has a %s filesystem but %s was expected",
+			vol.Name, dev, found, fs)
+	case policy == FormatNever:
+		return false, fmt.Errorf("Volume %s is blank and its %s is %s", vol.Name, OptFormatPol, FormatNever)
+	}
+	co.Infof(ctxt, "Formatting blank volume %s device %s as %s", vol.Name, dev, fs)
+	return true, mkfs(ctxt, dev, fs, false, opts)
+}
+
+// setOwnership applies the uid, gid and mode volume options to the root of
+// the mounted filesystem
+func setOwnership(ctxt context.Context, md dc.VolMetadata, mountpoint string) error {
+	uid, gid := -1, -1
+	if v, ok := md[OptUid]; ok {
+		uid, _ = strconv.Atoi(v)
+	}
+	if v, ok := md[OptGid]; ok {
+		gid, _ = strconv.Atoi(v)
+	}
+	if uid != -1 || gid != -1 {
+		co.Debugf(ctxt, "Setting owner of %s to %d:%d", mountpoint, uid, gid)
+		if err := os.Chown(mountpoint, uid, gid); err != nil {
+			return err
+		}
+	}
+	if v, ok := md[OptMode]; ok {
+		mode, _ := strconv.ParseUint(v, 8, 32)
+		co.Debugf(ctxt, "Setting mode of %s to %s", mountpoint, v)
+		if err := os.Chmod(mountpoint, fileMode(mode)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fileMode converts an octal mode as given to chmod(1) into an os.FileMode,
+// which keeps the setuid, setgid and sticky bits apart from the permissions
+func fileMode(mode uint64) os.FileMode {
+	m := os.FileMode(mode & 0777)
+	if mode&04000 != 0 {
+		m |= os.ModeSetuid
+	}
+	if mode&02000 != 0 {
+		m |= os.ModeSetgid
+	}
+	if mode&01000 != 0 {
+		m |= os.ModeSticky
+	}
+	return m
+}
@@ -0,0 +1,48 @@
+package driver
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"testing"
+
+	dc "github.com/Datera/datera-csi/pkg/client"
+)
+
+func TestFileMode(t *testing.T) {
+	tests := []struct {
+		mode uint64
+		want os.FileMode
+	}{
+		{0755, 0755},
+		{0, 0},
+		{01777, os.ModeSticky | 0777},
+		{02770, os.ModeSetgid | 0770},
+		{04755, os.ModeSetuid | 0755},
+		{07000, os.ModeSetuid | os.ModeSetgid | os.ModeSticky},
+	}
+	for _, tt := range tests {
+		if got := fileMode(tt.mode); got != tt.want {
+			t.Errorf("fileMode(%#o) = %s, want %s", tt.mode, got, tt.want)
+		}
+	}
+}
+
+func TestSetOwnership(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mount")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	md := dc.VolMetadata{OptUid: strconv.Itoa(os.Getuid()), OptGid: strconv.Itoa(os.Getgid()), OptMode: "2770"}
+	if err = setOwnership(testContext(), md, dir); err != nil {
+		t.Fatalf("setOwnership = %v", err)
+	}
+	fi, err := os.Stat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fi.Mode() & (os.ModePerm | os.ModeSetgid | os.ModeSetuid | os.ModeSticky); got != os.ModeSetgid|0770 {
+		t.Errorf("mode after setOwnership(2770) = %s, want %s", got, os.ModeSetgid|0770)
+	}
+}
@@ -0,0 +1,203 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	co "github.com/Datera/docker-driver/pkg/common"
+
+	dc "github.com/Datera/datera-csi/pkg/client"
+)
+
+// Metadata key holding when a volume was created or last detached from a
+// host, whichever is later
+const MdLastUsed = "lastUsed"
+
+// GCConfig controls the collection of volumes left unattached for longer
+// than their ttl option.  A zero Interval disables it
+type GCConfig struct {
+	Interval Duration `json:"interval"`
+
+	// DryRun only reports the volumes that would be deleted
+	DryRun bool `json:"dry_run"`
+
+	// MaxPerRun caps the volumes deleted by a single run
+	MaxPerRun int `json:"max_per_run"`
+}
+
+// GCCandidate is a volume unattached for longer than its ttl and whether a
+// collection run deleted it
+type GCCandidate struct {
+	Name    string
+	Idle    time.Duration
+	Ttl     time.Duration
+	Deleted bool
+}
+
+// lastUsed returns when the volume was last used, if recorded
+func lastUsed(md dc.VolMetadata) (time.Time, bool) {
+	t, err := time.Parse(time.RFC3339, md[MdLastUsed])
+	return t, err == nil
+}
+
+// touch records that a volume was used now
+func (d *DateraDriver) touch(ctxt context.Context, vol *dc.Volume) {
+	_, err := vol.SetMetadata(&dc.VolMetadata{MdLastUsed: time.Now().UTC().Format(time.RFC3339)})
+	if err != nil {
+		co.Warningf(ctxt, "Could not record last use of volume %s: %s", vol.Name, err)
+	}
+}
+
+// idle reports whether no host uses or has access to a volume
+func (d *DateraDriver) idle(ctxt context.Context, vol *dc.Volume, md dc.VolMetadata) (bool, error) {
+	d.Mutex.Lock()
+	_, local := d.attaches[vol.Name]
+	d.Mutex.Unlock()
+	if local || d.isStaged(vol.Name) {
+		return false, nil
+	}
+	for k, v := range md {
+		if strings.HasPrefix(k, usersKeyPrefix) && v != "" {
+			return false, nil
+		}
+	}
+	// Nothing is excluded, this host's own initiator counts too
+	inits, err := d.remoteInitiators(ctxt, vol, &dc.Initiator{})
+	if err != nil {
+		return false, err
+	}
+	return len(inits) == 0, nil
+}
+
+// collectable returns the ttl of a volume and whether its metadata allows
+// collecting it: only volumes fully created by the driver and given a ttl,
+// neither soft deleted nor holding subPath volumes
+func collectable(name string, md dc.VolMetadata) (time.Duration, bool, error) {
+	if _, ok := md[OptFstype]; !ok || md[OptTtl] == "" {
+		return 0, false, nil
+	}
+	ttl, err := time.ParseDuration(md[OptTtl])
+	if err != nil {
+		return 0, false, err
+	}
+	if _, ok := deletedAt(md); ok || len(subVolumesOf(name, md)) != 0 {
+		return 0, false, nil
+	}
+	return ttl, true, nil
+}
+
+// runGC collects idle volumes on the configured interval until ctxt is done
+func (d *DateraDriver) runGC(ctxt context.Context) {
+	t := time.NewTicker(d.Config.GC.Interval.Duration)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-ctxt.Done():
+			return
+		}
+		if _, err := d.CollectGarbage(d.Config.GC.DryRun); err != nil {
+			co.Errorf(topctxt, "Volume collection failed: %s", err)
+		}
+	}
+}
+
+// CollectGarbage finds the volumes created by the driver that have been
+// unattached for longer than their ttl option and, unless dryRun is set,
+// removes up to GC.MaxPerRun of them.  Removal honors soft_delete and
+// delete_failures
+func (d *DateraDriver) CollectGarbage(dryRun bool) (_ []GCCandidate, err error) {
+	ctxt, cancel := d.initFunc("CollectGarbage")
+	defer cancel()
+	defer func() { err = timedOut(ctxt, "", err) }()
+	var vols []*dc.Volume
+	err = d.retry(ctxt, "ListVolumes", func() error {
+		var err error
+		vols, err = d.DateraClient.ListVolumes(0, 0)
+		return classify("ListVolumes", "", err)
+	})
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	found := []GCCandidate{}
+	deleted := 0
+	for _, vol := range vols {
+		md, err := getMetadata(vol)
+		if err != nil {
+			co.Warningf(ctxt, "Could not read metadata of volume %s: %s", vol.Name, err)
+			continue
+		}
+		ttl, ok, err := collectable(vol.Name, md)
+		if err != nil {
+			co.Warningf(ctxt, "Volume %s has an invalid %s: %s", vol.Name, OptTtl, md[OptTtl])
+			continue
+		} else if !ok {
+			continue
+		}
+		if idle, err := d.idle(ctxt, vol, md); err != nil {
+			co.Warningf(ctxt, "Could not check whether volume %s is attached: %s", vol.Name, err)
+			continue
+		} else if !idle {
+			continue
+		}
+		last, ok := lastUsed(md)
+		if !ok {
+			// Start the clock on volumes from before last use was tracked
+			d.touch(ctxt, vol)
+			continue
+		}
+		if now.Sub(last) < ttl {
+			continue
+		}
+		c := GCCandidate{Name: vol.Name, Idle: now.Sub(last), Ttl: ttl}
+		switch {
+		case dryRun:
+			co.Infof(ctxt, "Volume %s has been unattached for %s, past its %s of %s", vol.Name, c.Idle, OptTtl, ttl)
+		case deleted >= d.Config.GC.MaxPerRun:
+			co.Warningf(ctxt, "Not collecting volume %s, reached max_per_run of %d", vol.Name, d.Config.GC.MaxPerRun)
+		default:
+			co.Warningf(ctxt, "AUDIT: collecting volume %s unattached for %s, past its %s of %s",
+				vol.Name, c.Idle, OptTtl, ttl)
+			if err = d.collect(ctxt, vol.Name); err != nil {
+				co.Errorf(ctxt, "Could not collect volume %s: %s", vol.Name, err)
+			} else {
+				c.Deleted = true
+				deleted++
+			}
+		}
+		found = append(found, c)
+	}
+	return found, nil
+}
+
+// collect removes an idle volume the same way Remove would.  Another host
+// may have mounted it since it was found idle, so it is checked again under
+// d.Mutex.  Unlike Remove, force_remove never lets a used volume go
+func (d *DateraDriver) collect(ctxt context.Context, name string) error {
+	d.Mutex.Lock()
+	defer d.Mutex.Unlock()
+	vol, sv, err := d.lookup(ctxt, name)
+	if err != nil {
+		return err
+	} else if sv != nil {
+		return fmt.Errorf("volume is a subPath volume")
+	}
+	if _, ok := d.attaches[name]; ok || d.isStaged(name) {
+		return fmt.Errorf("volume was mounted on this host")
+	}
+	users, err := d.inUse(ctxt, vol, name, nil)
+	if err != nil {
+		return err
+	} else if len(users) != 0 {
+		return fmt.Errorf("volume is in use by [%s]", strings.Join(users, ", "))
+	}
+	if md, err := getMetadata(vol); err != nil {
+		return err
+	} else if svs := subVolumesOf(name, md); len(svs) != 0 {
+		return fmt.Errorf("volume holds %d subPath volumes", len(svs))
+	}
+	return d.deleteVolume(ctxt, vol)
+}
@@ -0,0 +1,64 @@
+package driver
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	dc "github.com/Datera/datera-csi/pkg/client"
+)
+
+func TestCollectable(t *testing.T) {
+	tests := []struct {
+		name    string
+		md      dc.VolMetadata
+		ttl     time.Duration
+		ok      bool
+		wantErr bool
+	}{
+		{"ttl", dc.VolMetadata{OptFstype: "ext4", OptTtl: "72h"}, 72 * time.Hour, true, false},
+		{"no ttl", dc.VolMetadata{OptFstype: "ext4"}, 0, false, false},
+		{"not created by the driver", dc.VolMetadata{OptTtl: "72h"}, 0, false, false},
+		{"invalid ttl", dc.VolMetadata{OptFstype: "ext4", OptTtl: "3d"}, 0, false, true},
+		{"soft deleted", dc.VolMetadata{OptFstype: "ext4", OptTtl: "72h",
+			MdDeletedAt: "2019-04-11T19:23:51Z"}, 0, false, false},
+		{"subPath source", dc.VolMetadata{OptFstype: "ext4", OptTtl: "72h",
+			subPathKeyPrefix + "app1": "data/app1"}, 0, false, false},
+		{"removed subPath", dc.VolMetadata{OptFstype: "ext4", OptTtl: "72h",
+			subPathKeyPrefix + "app1": ""}, 72 * time.Hour, true, false},
+	}
+	for _, tt := range tests {
+		ttl, ok, err := collectable("vol1", tt.md)
+		if ttl != tt.ttl || ok != tt.ok || (err != nil) != tt.wantErr {
+			t.Errorf("%s: collectable = %s, %t, %v, want %s, %t, error %t",
+				tt.name, ttl, ok, err, tt.ttl, tt.ok, tt.wantErr)
+		}
+	}
+}
+
+func TestIdle(t *testing.T) {
+	d := &DateraDriver{
+		Mutex:    &sync.Mutex{},
+		attaches: map[string]*attachOp{"attached": testOp("attached", true, nil, false)},
+		subPaths: newSubPaths(),
+	}
+	d.subPaths.stagings["staged"] = &staging{users: map[string]bool{}, done: make(chan struct{})}
+	tests := []struct {
+		name string
+		md   dc.VolMetadata
+		want bool
+	}{
+		{"unused", dc.VolMetadata{}, true},
+		{"attached", dc.VolMetadata{}, false},
+		{"staged", dc.VolMetadata{}, false},
+		{"mounted elsewhere", dc.VolMetadata{usersKey("host2", "mounted elsewhere"): "abc123"}, false},
+		{"unmounted elsewhere", dc.VolMetadata{usersKey("host2", "unmounted elsewhere"): ""}, true},
+	}
+	for _, tt := range tests {
+		// Without an app instance there are no ACLs or sessions to check
+		idle, err := d.idle(testContext(), &dc.Volume{Name: tt.name}, tt.md)
+		if idle != tt.want || err != nil {
+			t.Errorf("%s: idle = %t, %v, want %t", tt.name, idle, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	co "github.com/Datera/docker-driver/pkg/common"
+
+	dc "github.com/Datera/datera-csi/pkg/client"
+)
+
+const (
+	// Metadata keys holding host leases are this prefix followed by the
+	// holder's initiator IQN.  Released leases are left behind empty
+	leaseKeyPrefix = "lease:"
+
+	// Metadata key recording the last takeover of a volume
+	MdTakeover = "takeover"
+)
+
+// LeaseConfig controls the leases hosts hold on the volumes they have
+// mounted.  A zero Duration disables leases
+type LeaseConfig struct {
+	// Duration a lease is valid for.  Leases are renewed every third of it
+	Duration Duration `json:"duration"`
+
+	// Grace is how long past its expiry a lease is still honored before
+	// another host may take the volume over.  It must cover clock skew
+	// between hosts
+	Grace Duration `json:"grace"`
+}
+
+// lease is a host's claim on a volume, stored as JSON in its metadata
+type lease struct {
+	Host      string    `json:"host"`
+	Initiator string    `json:"initiator"`
+	Expiry    time.Time `json:"expiry"`
+}
+
+// takeover is the audit record of a volume taken over from other hosts,
+// either by Mount or by the release command
+type takeover struct {
+	Action string    `json:"action"`
+	Time   time.Time `json:"time"`
+	Host   string    `json:"host"`
+	From   []string  `json:"from"`
+	Forced bool      `json:"forced"`
+}
+
+func leaseKey(iqn string) string {
+	return leaseKeyPrefix + iqn
+}
+
+// leasesOf returns the leases recorded in a volume's metadata by initiator
+func leasesOf(ctxt context.Context, md dc.VolMetadata) map[string]lease {
+	leases := map[string]lease{}
+	for k, v := range md {
+		if !strings.HasPrefix(k, leaseKeyPrefix) || v == "" {
+			continue
+		}
+		l := lease{}
+		if err := json.Unmarshal([]byte(v), &l); err != nil {
+			co.Warningf(ctxt, "Ignoring invalid lease %s: %s", k, err)
+			continue
+		}
+		leases[strings.TrimPrefix(k, leaseKeyPrefix)] = l
+	}
+	return leases
+}
+
+// leaseExpired reports whether a lease has been expired for longer than
+// the grace period
+func (d *DateraDriver) leaseExpired(l lease, now time.Time) bool {
+	return now.After(l.Expiry.Add(d.Config.Lease.Grace.Duration))
+}
+
+// writeLease writes this host's lease on a volume, valid for another
+// Lease.Duration
+func (d *DateraDriver) writeLease(ctxt context.Context, vol *dc.Volume, init *dc.Initiator) error {
+	b, err := json.Marshal(lease{
+		Host:      host,
+		Initiator: init.Iqn,
+		Expiry:    time.Now().Add(d.Config.Lease.Duration.Duration),
+	})
+	if err != nil {
+		return err
+	}
+	return d.retry(ctxt, "SetMetadata", func() error {
+		_, err := vol.SetMetadata(&dc.VolMetadata{leaseKey(init.Iqn): string(b)})
+		return classify("SetMetadata", vol.Name, err)
+	})
+}
+
+// releaseLease drops this host's lease on a volume
+func (d *DateraDriver) releaseLease(ctxt context.Context, vol *dc.Volume, init *dc.Initiator) error {
+	if d.Config.Lease.Duration.Duration == 0 {
+		return nil
+	}
+	return d.retry(ctxt, "SetMetadata", func() error {
+		_, err := vol.SetMetadata(&dc.VolMetadata{leaseKey(init.Iqn): ""})
+		return classify("SetMetadata", vol.Name, err)
+	})
+}
+
+// auditTakeover logs a takeover of a volume from other hosts and records it
+// in the volume's metadata along with dropping their leases.  action is
+// "mount" or "release"
+func (d *DateraDriver) auditTakeover(ctxt context.Context, vol *dc.Volume, action string, from []string, forced bool) error {
+	co.Warningf(ctxt, "AUDIT: host %s took over volume %s from [%s] by %s, forced: %t",
+		host, vol.Name, strings.Join(from, ", "), action, forced)
+	b, err := json.Marshal(takeover{Action: action, Time: time.Now(), Host: host, From: from, Forced: forced})
+	if err != nil {
+		return err
+	}
+	old, err := getMetadata(vol)
+	if err != nil {
+		return err
+	}
+	leases := leasesOf(ctxt, old)
+	md := dc.VolMetadata{MdTakeover: string(b)}
+	for _, iqn := range from {
+		md[leaseKey(iqn)] = ""
+		// The containers of a host that lost the volume aren't using it
+		l, ok := leases[iqn]
+		if !ok {
+			continue
+		}
+		for k, v := range old {
+			if strings.HasPrefix(k, usersKeyPrefix+l.Host+":") && v != "" {
+				md[k] = ""
+			}
+		}
+	}
+	_, err = vol.SetMetadata(&md)
+	return classify("SetMetadata", vol.Name, err)
+}
+
+// runHeartbeat renews the leases of the volumes attached to this host until
+// ctxt is done
+func (d *DateraDriver) runHeartbeat(ctxt context.Context) {
+	t := time.NewTicker(d.Config.Lease.Duration.Duration / 3)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-ctxt.Done():
+			return
+		}
+		d.renewLeases()
+	}
+}
+
+// renewLeases renews this host's lease on every volume it has attached or
+// is attaching.  Volumes whose attach hasn't taken a lease yet, or that no
+// container has claimed, are skipped
+func (d *DateraDriver) renewLeases() {
+	ctxt, cancel := d.initFunc("Heartbeat")
+	defer cancel()
+	init, err := d.getInitiator(ctxt)
+	if err != nil {
+		co.Errorf(ctxt, "Could not renew leases: %s", err)
+		return
+	}
+	for _, a := range d.attachedVolumes(true) {
+		if !a.claimed {
+			continue
+		}
+		vol, err := d.getVolume(ctxt, a.name, false, true)
+		if err != nil {
+			co.Warningf(ctxt, "Could not renew lease on volume %s: %s", a.name, err)
+			continue
+		}
+		md, err := getMetadata(vol)
+		if err != nil {
+			co.Warningf(ctxt, "Could not renew lease on volume %s: %s", a.name, err)
+			continue
+		}
+		if md[leaseKey(init.Iqn)] == "" {
+			continue
+		}
+		if err = d.writeLease(ctxt, vol, init); err != nil {
+			co.Errorf(ctxt, "Could not renew lease on volume %s: %s", a.name, err)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package driver
+
+import (
+	"testing"
+	"time"
+
+	dc "github.com/Datera/datera-csi/pkg/client"
+)
+
+func TestLeasesOf(t *testing.T) {
+	md := dc.VolMetadata{
+		OptFstype: "ext4",
+		leaseKey("iqn.1993-08.org.debian:01:host1"): `{"host":"host1","initiator":"iqn.1993-08.org.debian:01:host1","expiry":"2019-04-11T19:23:51Z"}`,
+		// Released leases are left behind empty
+		leaseKey("iqn.1993-08.org.debian:01:host2"): "",
+		leaseKey("iqn.1993-08.org.debian:01:host3"): "{not json",
+		usersKey("host1", "vol1"):                   "abc123",
+	}
+	leases := leasesOf(testContext(), md)
+	if len(leases) != 1 {
+		t.Fatalf("leasesOf = %v, want only the lease of host1", leases)
+	}
+	l, ok := leases["iqn.1993-08.org.debian:01:host1"]
+	want := time.Date(2019, 4, 11, 19, 23, 51, 0, time.UTC)
+	if !ok || l.Host != "host1" || !l.Expiry.Equal(want) {
+		t.Errorf("lease of host1 = %#v, want host1 expiring at %s", l, want)
+	}
+}
+
+func TestLeaseExpired(t *testing.T) {
+	d := &DateraDriver{Config: DefaultConfig()}
+	d.Config.Lease.Grace = Duration{2 * time.Minute}
+	now := time.Date(2019, 4, 11, 19, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		expiry time.Time
+		want   bool
+	}{
+		{"valid", now.Add(time.Minute), false},
+		{"just expired", now.Add(-time.Second), false},
+		{"within grace", now.Add(-2 * time.Minute), false},
+		{"past grace", now.Add(-2*time.Minute - time.Second), true},
+		{"long gone", now.Add(-24 * time.Hour), true},
+	}
+	for _, tt := range tests {
+		if got := d.leaseExpired(lease{Host: "host1", Expiry: tt.expiry}, now); got != tt.want {
+			t.Errorf("%s: leaseExpired(%s) = %t, want %t", tt.name, tt.expiry, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	co "github.com/Datera/docker-driver/pkg/common"
+
+	dc "github.com/Datera/datera-csi/pkg/client"
+)
+
+const (
+	// Delete failure modes, see Config.DeleteFailures
+	DeleteReturn = "return"
+	DeleteQueue  = "queue"
+)
+
+// Orphan is a volume Docker removed but the backend failed to delete
+type Orphan struct {
+	Name string `json:"name"`
+
+	// Path of the AppInstance, so a volume created later under the same
+	// name is never deleted in its place
+	Path      string    `json:"path"`
+	FailedAt  time.Time `json:"failed_at"`
+	Attempts  int       `json:"attempts"`
+	LastError string    `json:"last_error"`
+}
+
+// orphanQueue is the list of orphans pending deletion, kept in a local file
+// so it survives restarts of the driver
+type orphanQueue struct {
+	mutex *sync.Mutex
+	path  string
+}
+
+func newOrphanQueue(path string) *orphanQueue {
+	return &orphanQueue{mutex: &sync.Mutex{}, path: path}
+}
+
+// load reads the queue.  A missing file is an empty queue.  q.mutex must be
+// held
+func (q *orphanQueue) load() ([]Orphan, error) {
+	orphans := []Orphan{}
+	b, err := ioutil.ReadFile(q.path)
+	if os.IsNotExist(err) {
+		return orphans, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(b, &orphans); err != nil {
+		return nil, err
+	}
+	return orphans, nil
+}
+
+// save replaces the queue file.  q.mutex must be held
+func (q *orphanQueue) save(orphans []Orphan) error {
+	b, err := json.MarshalIndent(orphans, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(q.path), 0755); err != nil {
+		return err
+	}
+	tmp := q.path + ".tmp"
+	if err = ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, q.path)
+}
+
+// add queues a volume whose delete failed
+func (q *orphanQueue) add(vol *dc.Volume, derr error) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	orphans, err := q.load()
+	if err != nil {
+		return err
+	}
+	o := Orphan{Name: vol.Name, FailedAt: time.Now(), Attempts: 1, LastError: derr.Error()}
+	if vol.Ai != nil {
+		o.Path = vol.Ai.Path
+	}
+	for i := range orphans {
+		if orphans[i].Name == o.Name {
+			orphans[i] = o
+			return q.save(orphans)
+		}
+	}
+	return q.save(append(orphans, o))
+}
+
+// has reports whether a volume is queued for deletion.  An unreadable
+// queue is logged and treated as empty so lookups keep working
+func (q *orphanQueue) has(ctxt context.Context, name string) bool {
+	names, err := q.names()
+	if err != nil {
+		co.Warningf(ctxt, "Could not read orphan queue %s: %s", q.path, err)
+	}
+	return names[name]
+}
+
+// names returns the names of the volumes queued for deletion
+func (q *orphanQueue) names() (map[string]bool, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	orphans, err := q.load()
+	if err != nil {
+		return nil, err
+	}
+	names := map[string]bool{}
+	for _, o := range orphans {
+		names[o.Name] = true
+	}
+	return names, nil
+}
+
+// Orphans returns the volumes waiting to be deleted again
+func (d *DateraDriver) Orphans() ([]Orphan, error) {
+	d.orphans.mutex.Lock()
+	defer d.orphans.mutex.Unlock()
+	return d.orphans.load()
+}
+
+// runOrphanRetry retries deleting orphans on the configured interval until
+// ctxt is done
+func (d *DateraDriver) runOrphanRetry(ctxt context.Context) {
+	t := time.NewTicker(d.Config.OrphanRetry.Duration)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-ctxt.Done():
+			return
+		}
+		d.retryOrphans()
+	}
+}
+
+// orphanRetry is the outcome of retrying the delete of an orphan.  left is
+// the orphan to keep queued, nil once it is gone
+type orphanRetry struct {
+	tried Orphan
+	left  *Orphan
+}
+
+// mergeOrphans applies the outcome of a retry pass to the queue as it is
+// now.  Volumes queued again or for the first time while the pass ran are
+// kept as they are
+func mergeOrphans(current []Orphan, retries []orphanRetry) []Orphan {
+	byName := map[string]orphanRetry{}
+	for _, r := range retries {
+		byName[r.tried.Name] = r
+	}
+	left := []Orphan{}
+	for _, o := range current {
+		r, ok := byName[o.Name]
+		if !ok || o.Path != r.tried.Path || !o.FailedAt.Equal(r.tried.FailedAt) {
+			left = append(left, o)
+			continue
+		}
+		if r.left != nil {
+			left = append(left, *r.left)
+		}
+	}
+	return left
+}
+
+// retryOrphans tries to delete every queued orphan once, dropping those
+// that are gone or were replaced by a new volume of the same name.  The
+// queue isn't locked during the backend calls so lookups aren't held up
+func (d *DateraDriver) retryOrphans() {
+	ctxt, cancel := d.initFunc("RetryOrphans")
+	defer cancel()
+	d.orphans.mutex.Lock()
+	orphans, err := d.orphans.load()
+	d.orphans.mutex.Unlock()
+	if err != nil {
+		co.Errorf(ctxt, "Could not read orphan queue %s: %s", d.orphans.path, err)
+		return
+	}
+	if len(orphans) == 0 {
+		return
+	}
+	retries := []orphanRetry{}
+	for _, o := range orphans {
+		retries = append(retries, orphanRetry{tried: o, left: d.retryOrphan(ctxt, o)})
+	}
+	d.orphans.mutex.Lock()
+	defer d.orphans.mutex.Unlock()
+	if orphans, err = d.orphans.load(); err != nil {
+		co.Errorf(ctxt, "Could not read orphan queue %s: %s", d.orphans.path, err)
+		return
+	}
+	if err = d.orphans.save(mergeOrphans(orphans, retries)); err != nil {
+		co.Errorf(ctxt, "Could not write orphan queue %s: %s", d.orphans.path, err)
+	}
+}
+
+// retryOrphan tries to delete an orphan and returns it updated if it has
+// to stay queued
+func (d *DateraDriver) retryOrphan(ctxt context.Context, o Orphan) *Orphan {
+	vol, err := d.getVolume(ctxt, o.Name, false, false)
+	if IsNotFound(err) {
+		co.Infof(ctxt, "Orphaned volume %s is gone", o.Name)
+		return nil
+	}
+	if err == nil && vol.Ai != nil && o.Path != "" && vol.Ai.Path != o.Path {
+		co.Infof(ctxt, "Orphaned volume %s is gone, a new volume has its name", o.Name)
+		return nil
+	}
+	if err == nil {
+		err = classify("Delete", o.Name, vol.Delete(true))
+	}
+	if err == nil || IsNotFound(err) {
+		co.Infof(ctxt, "Deleted orphaned volume %s after %d attempts", o.Name, o.Attempts+1)
+		return nil
+	}
+	co.Warningf(ctxt, "Could not delete orphaned volume %s: %s", o.Name, err)
+	o.Attempts++
+	o.LastError = err.Error()
+	return &o
+}
@@ -0,0 +1,92 @@
+package driver
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	dc "github.com/Datera/datera-csi/pkg/client"
+	dsdk "github.com/Datera/go-sdk/pkg/dsdk"
+)
+
+func tempQueue(t *testing.T) (*orphanQueue, func()) {
+	dir, err := ioutil.TempDir("", "orphans")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newOrphanQueue(filepath.Join(dir, "datera", "orphans.json")), func() { os.RemoveAll(dir) }
+}
+
+func TestOrphanQueue(t *testing.T) {
+	q, cleanup := tempQueue(t)
+	defer cleanup()
+	orphans, err := q.load()
+	if err != nil || len(orphans) != 0 {
+		t.Fatalf("load of a missing queue = %v, %v, want empty", orphans, err)
+	}
+	vol := &dc.Volume{Name: "vol1", Ai: &dsdk.AppInstance{Path: "/app_instances/1"}}
+	if err = q.add(vol, errors.New("timeout")); err != nil {
+		t.Fatalf("add = %v", err)
+	}
+	if err = q.add(&dc.Volume{Name: "vol2"}, errors.New("conflict")); err != nil {
+		t.Fatalf("add = %v", err)
+	}
+	// Queuing a volume again replaces its entry
+	if err = q.add(vol, errors.New("refused")); err != nil {
+		t.Fatalf("add = %v", err)
+	}
+	orphans, err = q.load()
+	if err != nil || len(orphans) != 2 {
+		t.Fatalf("load = %v, %v, want vol1 and vol2", orphans, err)
+	}
+	if o := orphans[0]; o.Name != "vol1" || o.Path != "/app_instances/1" || o.LastError != "refused" || o.Attempts != 1 {
+		t.Errorf("orphans[0] = %+v, want vol1 failed with refused", o)
+	}
+	if !q.has(testContext(), "vol2") || q.has(testContext(), "vol3") {
+		t.Errorf("has(vol2), has(vol3) = %t, %t, want true, false",
+			q.has(testContext(), "vol2"), q.has(testContext(), "vol3"))
+	}
+}
+
+func TestOrphanQueueCorrupt(t *testing.T) {
+	q, cleanup := tempQueue(t)
+	defer cleanup()
+	if err := os.MkdirAll(filepath.Dir(q.path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(q.path, []byte("[{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.load(); err == nil {
+		t.Errorf("load of a corrupt queue = nil, want an error")
+	}
+	if q.has(testContext(), "vol1") {
+		t.Errorf("has with a corrupt queue = true, want false")
+	}
+}
+
+func TestMergeOrphans(t *testing.T) {
+	at := time.Date(2019, 4, 11, 19, 23, 51, 0, time.UTC)
+	gone := Orphan{Name: "gone", Path: "/app_instances/1", FailedAt: at, Attempts: 1}
+	failed := Orphan{Name: "failed", Path: "/app_instances/2", FailedAt: at, Attempts: 1}
+	requeued := Orphan{Name: "requeued", Path: "/app_instances/3", FailedAt: at, Attempts: 1}
+	added := Orphan{Name: "added", Path: "/app_instances/4", FailedAt: at, Attempts: 1}
+	retried := failed
+	retried.Attempts, retried.LastError = 2, "timeout"
+	requeuedAgain := requeued
+	requeuedAgain.FailedAt = at.Add(time.Minute)
+	current := []Orphan{gone, failed, requeuedAgain, added}
+	retries := []orphanRetry{
+		{tried: gone},
+		{tried: failed, left: &retried},
+		{tried: requeued},
+	}
+	want := []Orphan{retried, requeuedAgain, added}
+	if got := mergeOrphans(current, retries); !reflect.DeepEqual(got, want) {
+		t.Errorf("mergeOrphans = %+v, want %+v", got, want)
+	}
+}
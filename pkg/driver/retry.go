@@ -0,0 +1,70 @@
+package driver
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	co "github.com/Datera/docker-driver/pkg/common"
+)
+
+// RetryPolicy controls how backend calls are retried after a transient
+// failure.  The delay between attempts starts at InitialBackoff and doubles
+// up to MaxBackoff, randomized by +/- Jitter (a fraction of the delay).  No
+// attempt is started once Deadline has passed since the first one
+type RetryPolicy struct {
+	MaxAttempts    int      `json:"max_attempts"`
+	InitialBackoff Duration `json:"initial_backoff"`
+	MaxBackoff     Duration `json:"max_backoff"`
+	Jitter         float64  `json:"jitter"`
+	Deadline       Duration `json:"deadline"`
+}
+
+// backoff returns the delay to wait before retry number attempt (starting
+// at 1)
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	b := p.InitialBackoff.Duration
+	for i := 1; i < attempt && b < p.MaxBackoff.Duration; i++ {
+		b *= 2
+	}
+	if b > p.MaxBackoff.Duration {
+		b = p.MaxBackoff.Duration
+	}
+	if p.Jitter > 0 {
+		b += time.Duration((rand.Float64()*2 - 1) * p.Jitter * float64(b))
+	}
+	return b
+}
+
+func retryable(err error) bool {
+	return IsTransient(err) || IsTimeout(err)
+}
+
+// retry calls f until it succeeds, fails with an error that isn't transient
+// or the retry policy is exhausted.  f must be idempotent and should return
+// errors passed through classify
+func (d *DateraDriver) retry(ctxt context.Context, op string, f func() error) error {
+	p := d.Config.Retry
+	start := time.Now()
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = f(); err == nil || !retryable(err) {
+			return err
+		}
+		if attempt >= p.MaxAttempts {
+			co.Errorf(ctxt, "%s: giving up after %d attempts: %s", op, attempt, err)
+			return err
+		}
+		wait := p.backoff(attempt)
+		if p.Deadline.Duration > 0 && time.Since(start)+wait > p.Deadline.Duration {
+			co.Errorf(ctxt, "%s: retry deadline of %s exceeded: %s", op, p.Deadline, err)
+			return err
+		}
+		co.Warningf(ctxt, "%s: attempt %d failed, retrying in %s: %s", op, attempt, wait, err)
+		select {
+		case <-time.After(wait):
+		case <-ctxt.Done():
+			return err
+		}
+	}
+}
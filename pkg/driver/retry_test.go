@@ -0,0 +1,68 @@
+package driver
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	p := RetryPolicy{
+		InitialBackoff: Duration{time.Second},
+		MaxBackoff:     Duration{10 * time.Second},
+	}
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second,
+		10 * time.Second, 10 * time.Second}
+	for i, w := range want {
+		if got := p.backoff(i + 1); got != w {
+			t.Errorf("backoff(%d) = %s, want %s", i+1, got, w)
+		}
+	}
+}
+
+func TestBackoffJitter(t *testing.T) {
+	p := RetryPolicy{
+		InitialBackoff: Duration{time.Second},
+		MaxBackoff:     Duration{10 * time.Second},
+		Jitter:         0.2,
+	}
+	for i := 0; i < 100; i++ {
+		if got := p.backoff(2); got < 1600*time.Millisecond || got > 2400*time.Millisecond {
+			t.Fatalf("backoff(2) with 20%% jitter = %s, want within 1.6s-2.4s", got)
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	d := &DateraDriver{Config: &Config{Retry: RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: Duration{time.Millisecond},
+		MaxBackoff:     Duration{time.Millisecond},
+	}}}
+	transient := &BackendError{Kind: ErrTransient, Err: errors.New("connection reset")}
+	notFound := &BackendError{Kind: ErrNotFound, Err: errors.New("not found")}
+	tests := []struct {
+		name     string
+		errs     []error
+		want     error
+		attempts int
+	}{
+		{"success", []error{nil}, nil, 1},
+		{"recovers", []error{transient, transient, nil}, nil, 3},
+		{"gives up", []error{transient, transient, transient, nil}, transient, 3},
+		{"not retryable", []error{notFound, nil}, notFound, 1},
+	}
+	for _, tt := range tests {
+		attempts := 0
+		err := d.retry(testContext(), "GetVolume", func() error {
+			attempts++
+			return tt.errs[attempts-1]
+		})
+		if err != tt.want {
+			t.Errorf("%s: retry = %v, want %v", tt.name, err, tt.want)
+		}
+		if attempts != tt.attempts {
+			t.Errorf("%s: %d attempts, want %d", tt.name, attempts, tt.attempts)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	co "github.com/Datera/docker-driver/pkg/common"
+
+	dc "github.com/Datera/datera-csi/pkg/client"
+	dsdk "github.com/Datera/go-sdk/pkg/dsdk"
+)
+
+const (
+	// Metadata keys marking a soft deleted volume, holding when and by
+	// which host it was removed
+	MdDeletedAt = "deletedAt"
+	MdDeletedBy = "deletedBy"
+)
+
+// SoftDeleteConfig keeps removed volumes for a retention period so they can
+// be restored.  A zero Retention deletes volumes immediately
+type SoftDeleteConfig struct {
+	Retention Duration `json:"retention"`
+
+	// ReapInterval is how often volumes past their retention are deleted
+	ReapInterval Duration `json:"reap_interval"`
+}
+
+// deletedAt returns when a volume was soft deleted, if it was
+func deletedAt(md dc.VolMetadata) (time.Time, bool) {
+	if md[MdDeletedAt] == "" {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339, md[MdDeletedAt])
+	if err != nil {
+		// Keep it until someone looks at it rather than reaping it early
+		return time.Now(), true
+	}
+	return t, true
+}
+
+// checkNotDeleted refuses to reuse the name of a soft deleted volume
+func (d *DateraDriver) checkNotDeleted(vol *dc.Volume) error {
+	md, err := getMetadata(vol)
+	if err != nil {
+		return err
+	}
+	if t, ok := deletedAt(md); ok {
+		return fmt.Errorf("Volume %s was removed at %s and is kept until %s, restore it or use another name",
+			vol.Name, md[MdDeletedAt], t.Add(d.Config.SoftDelete.Retention.Duration).Format(time.RFC3339))
+	}
+	return nil
+}
+
+// revokeAcls empties every ACL of a volume so no host can attach it
+func (d *DateraDriver) revokeAcls(ctxt context.Context, vol *dc.Volume) error {
+	if vol.Ai == nil {
+		return nil
+	}
+	for _, si := range vol.Ai.StorageInstances {
+		if si.AclPolicy == nil {
+			continue
+		}
+		err := d.retry(ctxt, "SetAclPolicy", func() error {
+			_, apierr, err := si.AclPolicy.Set(&dsdk.AclPolicySetRequest{Ctxt: ctxt, Initiators: []*dsdk.Initiator{}})
+			if err == nil && apierr != nil {
+				err = fmt.Errorf("%#v", apierr)
+			}
+			return classify("SetAclPolicy", vol.Name, err)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// softDelete marks a volume deleted and revokes access to it.  It is hidden
+// from Docker until restored or reaped
+func (d *DateraDriver) softDelete(ctxt context.Context, vol *dc.Volume) error {
+	if err := d.revokeAcls(ctxt, vol); err != nil {
+		return err
+	}
+	co.Infof(ctxt, "Soft deleting volume %s, it is kept for %s", vol.Name, d.Config.SoftDelete.Retention)
+	_, err := vol.SetMetadata(&dc.VolMetadata{
+		MdDeletedAt: time.Now().UTC().Format(time.RFC3339),
+		MdDeletedBy: host,
+	})
+	return classify("SetMetadata", vol.Name, err)
+}
+
+// Restore brings back a soft deleted volume under its original name
+func (d *DateraDriver) Restore(name string) (err error) {
+	ctxt, cancel := d.initFunc("Restore")
+	defer cancel()
+	defer func() { err = timedOut(ctxt, name, err) }()
+	d.Mutex.Lock()
+	defer d.Mutex.Unlock()
+	vol, err := d.getVolume(ctxt, name, false, true)
+	if err != nil {
+		return err
+	}
+	md, err := getMetadata(vol)
+	if err != nil {
+		return err
+	}
+	if _, ok := deletedAt(md); !ok {
+		return fmt.Errorf("Volume %s is not deleted", name)
+	}
+	co.Infof(ctxt, "Restoring volume %s deleted by %s at %s", name, md[MdDeletedBy], md[MdDeletedAt])
+	_, err = vol.SetMetadata(&dc.VolMetadata{MdDeletedAt: "", MdDeletedBy: ""})
+	return classify("SetMetadata", name, err)
+}
+
+// runReaper deletes soft deleted volumes past their retention on the
+// configured interval until ctxt is done
+func (d *DateraDriver) runReaper(ctxt context.Context) {
+	t := time.NewTicker(d.Config.SoftDelete.ReapInterval.Duration)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-ctxt.Done():
+			return
+		}
+		d.reap()
+	}
+}
+
+// reap deletes every soft deleted volume whose retention has expired
+func (d *DateraDriver) reap() {
+	ctxt, cancel := d.initFunc("Reap")
+	defer cancel()
+	var vols []*dc.Volume
+	err := d.retry(ctxt, "ListVolumes", func() error {
+		var err error
+		vols, err = d.DateraClient.ListVolumes(0, 0)
+		return classify("ListVolumes", "", err)
+	})
+	if err != nil {
+		co.Errorf(ctxt, "Could not list volumes to reap: %s", err)
+		return
+	}
+	now := time.Now()
+	for _, vol := range vols {
+		md, err := getMetadata(vol)
+		if err != nil {
+			co.Warningf(ctxt, "Could not read metadata of volume %s: %s", vol.Name, err)
+			continue
+		}
+		t, ok := deletedAt(md)
+		if !ok || now.Before(t.Add(d.Config.SoftDelete.Retention.Duration)) {
+			continue
+		}
+		co.Infof(ctxt, "Reaping volume %s deleted by %s at %s", vol.Name, md[MdDeletedBy], md[MdDeletedAt])
+		if err = classify("Delete", vol.Name, vol.Delete(true)); err != nil && !IsNotFound(err) {
+			co.Errorf(ctxt, "Could not reap volume %s: %s", vol.Name, err)
+		}
+	}
+}
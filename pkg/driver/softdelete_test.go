@@ -0,0 +1,14 @@
+package driver
+
+import (
+	"testing"
+
+	dc "github.com/Datera/datera-csi/pkg/client"
+)
+
+func TestRevokeAclsNoAppInstance(t *testing.T) {
+	d := &DateraDriver{}
+	if err := d.revokeAcls(testContext(), &dc.Volume{Name: "vol1"}); err != nil {
+		t.Errorf("revokeAcls without an app instance = %v, want nil", err)
+	}
+}
@@ -0,0 +1,396 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	co "github.com/Datera/docker-driver/pkg/common"
+
+	dc "github.com/Datera/datera-csi/pkg/client"
+)
+
+const (
+	// Source volume metadata keys recording the subPath volumes mapped onto
+	// it are this prefix followed by the Docker volume name
+	subPathKeyPrefix = "subPath:"
+
+	// Source volumes of subPath volumes are mounted under this directory
+	StagingDir = ".staging"
+)
+
+// subVolume is a Docker volume that maps onto a subdirectory of a source
+// Datera volume rather than a volume of its own
+type subVolume struct {
+	Name   string
+	Source string
+	Path   string
+}
+
+// staging tracks a source volume mounted in its staging directory and the
+// subPath volumes currently bind mounted from it.  done is closed once the
+// source is mounted, subPath volumes attached meanwhile wait for it
+type staging struct {
+	users map[string]bool
+	done  chan struct{}
+}
+
+func (st *staging) finished() bool {
+	select {
+	case <-st.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// subPaths holds the state of subPath volumes on this host.  mutex guards
+// it but isn't held while a source volume is being staged
+type subPaths struct {
+	mutex    *sync.Mutex
+	known    map[string]subVolume
+	stagings map[string]*staging
+}
+
+func newSubPaths() *subPaths {
+	return &subPaths{
+		mutex:    &sync.Mutex{},
+		known:    map[string]subVolume{},
+		stagings: map[string]*staging{},
+	}
+}
+
+// StagingPath returns where a source volume is mounted while subPath volumes
+// on it are in use
+func (d *DateraDriver) StagingPath(source string) string {
+	return filepath.Join(MountLoc, StagingDir, source)
+}
+
+// checkSubPath verifies a subPath is a relative path that stays within the
+// source volume
+func checkSubPath(p string) error {
+	if p == "" || path.IsAbs(p) {
+		return fmt.Errorf("%s must be a relative path: %s", OptSubPath, p)
+	}
+	clean := path.Clean(p)
+	if clean == "." || clean == ".." || strings.HasPrefix(clean, "../") {
+		return fmt.Errorf("%s must be a subdirectory of the source volume: %s", OptSubPath, p)
+	}
+	return nil
+}
+
+// resolveSubPath resolves the symlinks in dir, a subPath of the source
+// volume mounted at stage, and refuses it if it leads off the volume
+func resolveSubPath(stage, dir string) (string, error) {
+	root, err := filepath.EvalSymlinks(stage)
+	if err != nil {
+		return "", err
+	}
+	real, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return "", err
+	}
+	if real != root && !strings.HasPrefix(real, root+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s %s resolves to %s outside of the source volume", OptSubPath, dir, real)
+	}
+	return real, nil
+}
+
+// makeSubPath creates the subPath directory dir of a source volume staged at
+// stage and returns it resolved.  It is created one component at a time and
+// each component is resolved and checked before anything is created in it,
+// then the whole path is checked again once it exists
+func makeSubPath(stage, dir string) (string, error) {
+	rel, err := filepath.Rel(stage, dir)
+	if err != nil {
+		return "", err
+	}
+	cur, err := resolveSubPath(stage, stage)
+	if err != nil {
+		return "", err
+	}
+	for _, c := range strings.Split(rel, string(filepath.Separator)) {
+		if c == "" || c == "." {
+			continue
+		}
+		// Mkdir doesn't follow a symlink in place of the directory
+		next := filepath.Join(cur, c)
+		if err = os.Mkdir(next, 0755); err != nil && !os.IsExist(err) {
+			return "", err
+		}
+		if cur, err = resolveSubPath(stage, next); err != nil {
+			return "", err
+		}
+	}
+	return resolveSubPath(stage, dir)
+}
+
+// subVolumesOf returns the subPath volumes recorded in a source volume's
+// metadata.  Removed subPath volumes are left behind with an empty path
+func subVolumesOf(source string, md dc.VolMetadata) []subVolume {
+	svs := []subVolume{}
+	for k, v := range md {
+		if strings.HasPrefix(k, subPathKeyPrefix) && v != "" {
+			svs = append(svs, subVolume{Name: strings.TrimPrefix(k, subPathKeyPrefix), Source: source, Path: v})
+		}
+	}
+	return svs
+}
+
+// scanSubVolumes finds every subPath volume by reading the metadata of all
+// volumes, refreshing the cache of known subPath volumes
+func (d *DateraDriver) scanSubVolumes(ctxt context.Context) (map[string]subVolume, error) {
+	var vols []*dc.Volume
+	err := d.retry(ctxt, "ListVolumes", func() error {
+		var err error
+		vols, err = d.DateraClient.ListVolumes(0, 0)
+		return classify("ListVolumes", "", err)
+	})
+	if err != nil {
+		return nil, err
+	}
+	found := map[string]subVolume{}
+	for _, vol := range vols {
+		md, err := getMetadata(vol)
+		if err != nil {
+			co.Warningf(ctxt, "Could not read metadata of volume %s: %s", vol.Name, err)
+			continue
+		}
+		for _, sv := range subVolumesOf(vol.Name, md) {
+			found[sv.Name] = sv
+		}
+	}
+	d.subPaths.mutex.Lock()
+	d.subPaths.known = found
+	d.subPaths.mutex.Unlock()
+	return found, nil
+}
+
+// lookup resolves a Docker volume name to either its Datera volume or the
+// subPath volume it refers to.  A NotFound error is returned if it is
+// neither, or if the volume was removed but not deleted yet
+func (d *DateraDriver) lookup(ctxt context.Context, name string) (*dc.Volume, *subVolume, error) {
+	d.subPaths.mutex.Lock()
+	sv, ok := d.subPaths.known[name]
+	d.subPaths.mutex.Unlock()
+	if ok {
+		return nil, &sv, nil
+	}
+	vol, err := d.getVolume(ctxt, name, true, true)
+	if err == nil {
+		// Soft deleted volumes are hidden until restored
+		var md dc.VolMetadata
+		if md, err = getMetadata(vol); err != nil {
+			return nil, nil, err
+		}
+		if _, ok := deletedAt(md); ok {
+			return nil, nil, &BackendError{Kind: ErrNotFound, Op: "GetVolume", Name: name,
+				Err: fmt.Errorf("volume was removed at %s", md[MdDeletedAt])}
+		}
+		// So are volumes whose delete failed and is being retried
+		if d.orphans.has(ctxt, name) {
+			return nil, nil, &BackendError{Kind: ErrNotFound, Op: "GetVolume", Name: name,
+				Err: fmt.Errorf("volume was removed and is queued for deletion")}
+		}
+		return vol, nil, nil
+	}
+	if !IsNotFound(err) {
+		return vol, nil, err
+	}
+	// Another host may have created it
+	found, serr := d.scanSubVolumes(ctxt)
+	if serr != nil {
+		return nil, nil, serr
+	}
+	if sv, ok := found[name]; ok {
+		return nil, &sv, nil
+	}
+	return nil, nil, err
+}
+
+// createSubVolume records a subPath volume in the metadata of its source
+func (d *DateraDriver) createSubVolume(ctxt context.Context, name string, volOpts map[string]string) error {
+	source := volOpts[OptSubPathSrc]
+	p := path.Clean(volOpts[OptSubPath])
+	src, err := d.getVolume(ctxt, source, false, true)
+	if IsNotFound(err) {
+		return fmt.Errorf("%s volume %s does not exist", OptSubPathSrc, source)
+	} else if err != nil {
+		return err
+	}
+	md, err := getMetadata(src)
+	if err != nil {
+		return err
+	}
+	if _, ok := deletedAt(md); ok {
+		return fmt.Errorf("%s volume %s does not exist", OptSubPathSrc, source)
+	}
+	if md[OptAccessType] == AccessBlock {
+		return fmt.Errorf("%s volume %s is a block volume", OptSubPathSrc, source)
+	}
+	key := subPathKeyPrefix + name
+	if existing := md[key]; existing != "" {
+		if existing != p {
+			return fmt.Errorf("Volume %s already exists with %s %s", name, OptSubPath, existing)
+		}
+		return nil
+	}
+	co.Infof(ctxt, "Mapping volume %s onto %s of volume %s", name, p, source)
+	if _, err = src.SetMetadata(&dc.VolMetadata{key: p}); err != nil {
+		return classify("SetMetadata", source, err)
+	}
+	d.subPaths.mutex.Lock()
+	d.subPaths.known[name] = subVolume{Name: name, Source: source, Path: p}
+	d.subPaths.mutex.Unlock()
+	return nil
+}
+
+// removeSubVolume removes a subPath volume from the metadata of its source.
+// The data in the subdirectory is left in place
+func (d *DateraDriver) removeSubVolume(ctxt context.Context, sv *subVolume) error {
+	d.subPaths.mutex.Lock()
+	delete(d.subPaths.known, sv.Name)
+	d.subPaths.mutex.Unlock()
+	src, err := d.getVolume(ctxt, sv.Source, false, true)
+	if IsNotFound(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	_, err = src.SetMetadata(&dc.VolMetadata{subPathKeyPrefix + sv.Name: ""})
+	return classify("SetMetadata", sv.Source, err)
+}
+
+// attachSubVolume makes a subPath volume available at its mountpoint.  The
+// source volume is attached and mounted in its staging directory by the
+// first subPath volume that needs it
+func (d *DateraDriver) attachSubVolume(ctxt context.Context, sv *subVolume) error {
+	stage := d.StagingPath(sv.Source)
+	st, err := d.stage(ctxt, sv.Source)
+	if err != nil {
+		return err
+	}
+	defer d.subPaths.mutex.Unlock()
+	dir := filepath.Join(stage, sv.Path)
+	m := d.MountPoint(sv.Name)
+	err = runSteps(ctxt, "Mount", []step{
+		{
+			Name: "create-subpath",
+			Do: func() error {
+				// Anyone who can write to the source volume can swap a
+				// component of the subPath for a symlink, so bind mount
+				// the resolved directory and only if it is still on the
+				// source volume
+				var err error
+				dir, err = makeSubPath(stage, dir)
+				return err
+			},
+		},
+		{
+			Name: "bind-mount",
+			Do: func() error {
+				if mounted, err := isMounted(m); err != nil || mounted {
+					return err
+				}
+				if err := os.MkdirAll(m, 0755); err != nil {
+					return err
+				}
+				_, err := run(ctxt, []string{"mount", "--bind", dir, m})
+				return err
+			},
+		},
+	})
+	if err == nil {
+		st.users[sv.Name] = true
+	} else if len(st.users) == 0 {
+		uctxt, cancel := undoContext(ctxt)
+		defer cancel()
+		d.unstage(uctxt, sv.Source)
+	}
+	return err
+}
+
+// stage returns the staging of a source volume, mounting it first if no
+// other subPath volume has.  The source is mounted without holding
+// d.subPaths.mutex, which can take as long as any attach, and is held again
+// when stage returns without error
+func (d *DateraDriver) stage(ctxt context.Context, source string) (*staging, error) {
+	for {
+		d.subPaths.mutex.Lock()
+		st, ok := d.subPaths.stagings[source]
+		if !ok {
+			break
+		}
+		// Failed stagings are dropped, so a finished one is mounted
+		if st.finished() {
+			return st, nil
+		}
+		d.subPaths.mutex.Unlock()
+		select {
+		case <-st.done:
+		case <-ctxt.Done():
+			return nil, ctxt.Err()
+		}
+	}
+	st := &staging{users: map[string]bool{}, done: make(chan struct{})}
+	d.subPaths.stagings[source] = st
+	d.subPaths.mutex.Unlock()
+	co.Infof(ctxt, "Staging volume %s at %s", source, d.StagingPath(source))
+	err := doMount(ctxt, d, source, d.StagingPath(source))
+	d.subPaths.mutex.Lock()
+	close(st.done)
+	if err != nil {
+		delete(d.subPaths.stagings, source)
+		d.subPaths.mutex.Unlock()
+		return nil, err
+	}
+	return st, nil
+}
+
+// detachSubVolume removes the bind mount of a subPath volume and detaches
+// its source once no other subPath volume uses it
+func (d *DateraDriver) detachSubVolume(ctxt context.Context, sv *subVolume) error {
+	d.subPaths.mutex.Lock()
+	defer d.subPaths.mutex.Unlock()
+	if err := unmountPath(ctxt, d.MountPoint(sv.Name)); err != nil {
+		return err
+	}
+	st, ok := d.subPaths.stagings[sv.Source]
+	if !ok || !st.finished() {
+		// Another subPath volume is staging the source, it owns it
+		return nil
+	}
+	delete(st.users, sv.Name)
+	if len(st.users) != 0 {
+		co.Debugf(ctxt, "Volume %s is still used by %d subPath volumes", sv.Source, len(st.users))
+		return nil
+	}
+	return d.unstage(ctxt, sv.Source)
+}
+
+// unstage detaches a source volume from its staging directory.
+// d.subPaths.mutex must be held
+func (d *DateraDriver) unstage(ctxt context.Context, source string) error {
+	delete(d.subPaths.stagings, source)
+	vol, err := d.getVolume(ctxt, source, false, true)
+	if IsNotFound(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	co.Infof(ctxt, "Unstaging volume %s", source)
+	return d.detach(ctxt, vol, d.StagingPath(source))
+}
+
+// isStaged reports whether a volume is mounted as the source of subPath
+// volumes on this host
+func (d *DateraDriver) isStaged(name string) bool {
+	d.subPaths.mutex.Lock()
+	defer d.subPaths.mutex.Unlock()
+	_, ok := d.subPaths.stagings[name]
+	return ok
+}
@@ -0,0 +1,136 @@
+package driver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckSubPath(t *testing.T) {
+	tests := []struct {
+		path    string
+		wantErr bool
+	}{
+		{"data", false},
+		{"data/app1", false},
+		{"data/../app1", false},
+		{"./data", false},
+		{"data/", false},
+		{"", true},
+		{".", true},
+		{"./", true},
+		{"..", true},
+		{"../data", true},
+		{"data/../../etc", true},
+		{"/data", true},
+		{"/", true},
+	}
+	for _, tt := range tests {
+		if err := checkSubPath(tt.path); (err != nil) != tt.wantErr {
+			t.Errorf("checkSubPath(%q) = %v, want error: %t", tt.path, err, tt.wantErr)
+		}
+	}
+}
+
+func TestResolveSubPath(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "subpath")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	root, err := filepath.EvalSymlinks(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stage := filepath.Join(root, "stage")
+	for _, dir := range []string{"data/app1", "data/app2"} {
+		if err = os.MkdirAll(filepath.Join(stage, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = os.MkdirAll(filepath.Join(root, "outside"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	links := map[string]string{
+		"data/inside":  filepath.Join(stage, "data/app2"),
+		"data/escape":  filepath.Join(root, "outside"),
+		"data/up":      "../..",
+		"data/sibling": filepath.Join(root, "stage-other"),
+	}
+	for l, target := range links {
+		if err = os.Symlink(target, filepath.Join(stage, l)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = os.MkdirAll(filepath.Join(root, "stage-other"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path    string
+		want    string
+		wantErr bool
+	}{
+		{"data/app1", filepath.Join(stage, "data/app1"), false},
+		{"data/inside", filepath.Join(stage, "data/app2"), false},
+		{"data/escape", "", true},
+		{"data/up", "", true},
+		{"data/sibling", "", true},
+		{"data/missing", "", true},
+	}
+	for _, tt := range tests {
+		got, err := resolveSubPath(stage, filepath.Join(stage, tt.path))
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("resolveSubPath(%s) = %q, %v, want %q, error: %t", tt.path, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestMakeSubPath(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "subpath")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	root, err := filepath.EvalSymlinks(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stage := filepath.Join(root, "stage")
+	outside := filepath.Join(root, "outside")
+	for _, dir := range []string{filepath.Join(stage, "data/app1"), outside} {
+		if err = os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = os.Symlink(outside, filepath.Join(stage, "escape")); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Symlink("data", filepath.Join(stage, "inside")); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path    string
+		want    string
+		wantErr bool
+	}{
+		{"data/app1", filepath.Join(stage, "data/app1"), false},
+		{"data/app2/logs", filepath.Join(stage, "data/app2/logs"), false},
+		{"inside/app3", filepath.Join(stage, "data/app3"), false},
+		{"escape/app4", "", true},
+		{"escape", "", true},
+	}
+	for _, tt := range tests {
+		got, err := makeSubPath(stage, filepath.Join(stage, tt.path))
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("makeSubPath(%s) = %q, %v, want %q, error: %t", tt.path, got, err, tt.want, tt.wantErr)
+		}
+	}
+	// Nothing may be created through a symlink leaving the volume
+	if entries, err := ioutil.ReadDir(outside); err != nil || len(entries) != 0 {
+		t.Errorf("outside of the volume has %d entries, %v, want none", len(entries), err)
+	}
+	if fi, err := os.Stat(filepath.Join(stage, "data/app2/logs")); err != nil || !fi.IsDir() {
+		t.Errorf("subPath data/app2/logs was not created: %v", err)
+	}
+}
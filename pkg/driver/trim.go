@@ -0,0 +1,179 @@
+package driver
+
+import (
+	"context"
+	"math/rand"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	co "github.com/Datera/docker-driver/pkg/common"
+)
+
+// util-linux fstrim -v reports "<mountpoint>: 1.2 GiB (1288490188 bytes)
+// trimmed" and the busybox one in the plugin image "<mountpoint>: 1288490188
+// bytes trimmed"
+var trimmedRe = regexp.MustCompile(`(\d+) bytes\)? trimmed`)
+
+// TrimConfig schedules fstrim on the volumes mounted on this host so space
+// freed in their filesystems is returned to the thin-provisioned Datera
+// volume.  A zero Interval disables trimming
+type TrimConfig struct {
+	// Interval between trim passes, randomized by +/- Jitter (a fraction of
+	// the interval) so hosts sharing a cluster don't trim in lockstep
+	Interval Duration `json:"interval"`
+	Jitter   float64  `json:"jitter"`
+
+	// Concurrency is the number of volumes trimmed at once
+	Concurrency int `json:"concurrency"`
+}
+
+// trimResult is the outcome of the last successful trim of a volume
+type trimResult struct {
+	Last  time.Time
+	Bytes uint64
+}
+
+// trimmer holds the state of the background trimmer.  running holds the
+// cancel function of each trim in progress, keyed by volume name, so Unmount
+// can stop a trim before the filesystem goes away
+type trimmer struct {
+	mutex   *sync.Mutex
+	running map[string]*runningTrim
+	results map[string]trimResult
+}
+
+type runningTrim struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func newTrimmer() *trimmer {
+	return &trimmer{
+		mutex:   &sync.Mutex{},
+		running: map[string]*runningTrim{},
+		results: map[string]trimResult{},
+	}
+}
+
+// runTrimmer runs trim passes on the configured schedule until ctxt is done
+func (d *DateraDriver) runTrimmer(ctxt context.Context) {
+	conf := d.Config.Trim
+	for {
+		wait := conf.Interval.Duration
+		if conf.Jitter > 0 {
+			wait += time.Duration((rand.Float64()*2 - 1) * conf.Jitter * float64(wait))
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctxt.Done():
+			return
+		}
+		d.trimPass()
+	}
+}
+
+// trimPass trims every filesystem volume mounted on this host, at most
+// Trim.Concurrency at a time
+func (d *DateraDriver) trimPass() {
+	ctxt, cancel := d.initFunc("Trim")
+	defer cancel()
+	targets := d.attachedVolumes(false)
+	co.Debugf(ctxt, "Starting trim pass of %d volumes", len(targets))
+	sem := make(chan struct{}, d.Config.Trim.Concurrency)
+	wg := &sync.WaitGroup{}
+	for _, t := range targets {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(t attachedVolume) {
+			defer func() { <-sem; wg.Done() }()
+			d.trimVolume(ctxt, t)
+		}(t)
+	}
+	wg.Wait()
+}
+
+// trimVolume runs fstrim on one volume unless it's a block, read-only or
+// trim=false volume
+func (d *DateraDriver) trimVolume(ctxt context.Context, t attachedVolume) {
+	vol, err := d.getVolume(ctxt, t.name, false, true)
+	if err != nil {
+		co.Warningf(ctxt, "Skipping trim of volume %s: %s", t.name, err)
+		return
+	}
+	md, err := getMetadata(vol)
+	if err != nil {
+		co.Warningf(ctxt, "Skipping trim of volume %s: %s", t.name, err)
+		return
+	}
+	if trim, err := strconv.ParseBool(md[OptTrim]); err == nil && !trim {
+		return
+	}
+	if md[OptAccessType] == AccessBlock || d.Config.ReadOnly || isReadOnly(md) {
+		return
+	}
+	tctxt, done := d.startTrim(ctxt, t)
+	if tctxt == nil {
+		return
+	}
+	defer done()
+	out, err := run(tctxt, []string{"fstrim", "-v", t.mount})
+	if err != nil {
+		co.Warningf(ctxt, "Trim of volume %s failed: %s", t.name, err)
+		return
+	}
+	res := trimResult{Last: time.Now()}
+	if m := trimmedRe.FindStringSubmatch(out); m != nil {
+		res.Bytes, _ = strconv.ParseUint(m[1], 10, 64)
+	}
+	co.Debugf(ctxt, "Trimmed %d bytes from volume %s", res.Bytes, t.name)
+	d.trims.mutex.Lock()
+	d.trims.results[t.name] = res
+	d.trims.mutex.Unlock()
+}
+
+// startTrim registers a trim of t so stopTrim can cancel it.  The volume
+// must still be mounted, which is checked under d.Mutex so it can't race
+// with Unmount.  A nil context is returned if the volume can't be trimmed
+func (d *DateraDriver) startTrim(ctxt context.Context, t attachedVolume) (context.Context, func()) {
+	d.Mutex.Lock()
+	defer d.Mutex.Unlock()
+	if mounted, err := isMounted(t.mount); err != nil || !mounted {
+		return nil, nil
+	}
+	tctxt, cancel := context.WithCancel(ctxt)
+	rt := &runningTrim{cancel: cancel, done: make(chan struct{})}
+	d.trims.mutex.Lock()
+	d.trims.running[t.name] = rt
+	d.trims.mutex.Unlock()
+	return tctxt, func() {
+		d.trims.mutex.Lock()
+		delete(d.trims.running, t.name)
+		d.trims.mutex.Unlock()
+		cancel()
+		close(rt.done)
+	}
+}
+
+// stopTrim cancels a trim of the volume in progress and waits for it to
+// exit.  d.Mutex must be held
+func (d *DateraDriver) stopTrim(ctxt context.Context, name string) {
+	d.trims.mutex.Lock()
+	rt, ok := d.trims.running[name]
+	d.trims.mutex.Unlock()
+	if !ok {
+		return
+	}
+	co.Debugf(ctxt, "Cancelling trim of volume %s", name)
+	rt.cancel()
+	<-rt.done
+}
+
+// lastTrim returns the last successful trim of a volume on this host
+func (d *DateraDriver) lastTrim(name string) (trimResult, bool) {
+	d.trims.mutex.Lock()
+	defer d.trims.mutex.Unlock()
+	res, ok := d.trims.results[name]
+	return res, ok
+}
@@ -0,0 +1,102 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	co "github.com/Datera/docker-driver/pkg/common"
+)
+
+// undoTimeout bounds the rollback of a failed multi-step operation
+const undoTimeout = 2 * time.Minute
+
+// step is a single unit of work within a multi-step driver operation.  Undo
+// is optional and reverses the effects of Do when a later step fails.  It is
+// given a context of its own since the operation's may be what failed it
+type step struct {
+	Name string
+	Do   func() error
+	Undo func(ctxt context.Context) error
+}
+
+// detached carries the values of a context, such as its trace ID, without
+// its deadline or cancellation
+type detached struct {
+	context.Context
+}
+
+func (detached) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detached) Done() <-chan struct{}       { return nil }
+func (detached) Err() error                  { return nil }
+
+// undoContext returns a context for cleaning up after ctxt was cancelled or
+// expired.  Host commands fail at once on a done context, which would leave
+// filesystems mounted and mappings open
+func undoContext(ctxt context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(detached{ctxt}, undoTimeout)
+}
+
+// RollbackError is returned when a multi-step operation fails part way
+// through.  It records the step that failed and the outcome of each undo
+// that was attempted while rolling back
+type RollbackError struct {
+	Op         string
+	Step       string
+	Err        error
+	Undone     []string
+	UndoFailed map[string]error
+}
+
+func (e *RollbackError) Error() string {
+	msg := fmt.Sprintf("%s failed at step '%s': %s", e.Op, e.Step, e.Err)
+	if len(e.Undone) == 0 && len(e.UndoFailed) == 0 {
+		return msg
+	}
+	parts := []string{}
+	for _, s := range e.Undone {
+		parts = append(parts, fmt.Sprintf("%s: ok", s))
+	}
+	for s, err := range e.UndoFailed {
+		parts = append(parts, fmt.Sprintf("%s: %s", s, err))
+	}
+	return fmt.Sprintf("%s. Rollback [%s]", msg, strings.Join(parts, ", "))
+}
+
+// runSteps executes steps in order.  If any step fails, the Undo functions
+// of the steps that already completed are run in reverse order and a
+// *RollbackError is returned
+func runSteps(ctxt context.Context, op string, steps []step) error {
+	for i, s := range steps {
+		co.Debugf(ctxt, "%s: running step %s", op, s.Name)
+		err := s.Do()
+		if err == nil {
+			continue
+		}
+		co.Errorf(ctxt, "%s: step %s failed: %s", op, s.Name, err)
+		uctxt, cancel := undoContext(ctxt)
+		defer cancel()
+		rerr := &RollbackError{
+			Op:         op,
+			Step:       s.Name,
+			Err:        err,
+			UndoFailed: map[string]error{},
+		}
+		for j := i - 1; j >= 0; j-- {
+			u := steps[j]
+			if u.Undo == nil {
+				continue
+			}
+			co.Debugf(ctxt, "%s: undoing step %s", op, u.Name)
+			if uerr := u.Undo(uctxt); uerr != nil {
+				co.Errorf(ctxt, "%s: undo of step %s failed: %s", op, u.Name, uerr)
+				rerr.UndoFailed[u.Name] = uerr
+			} else {
+				rerr.Undone = append(rerr.Undone, u.Name)
+			}
+		}
+		return rerr
+	}
+	return nil
+}
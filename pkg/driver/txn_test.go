@@ -0,0 +1,125 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	co "github.com/Datera/docker-driver/pkg/common"
+)
+
+// recorder builds steps that log what they did
+type recorder struct {
+	ran []string
+}
+
+func (r *recorder) step(name string, doErr, undoErr error) step {
+	return step{
+		Name: name,
+		Do: func() error {
+			r.ran = append(r.ran, "do "+name)
+			return doErr
+		},
+		Undo: func(ctxt context.Context) error {
+			r.ran = append(r.ran, "undo "+name)
+			return undoErr
+		},
+	}
+}
+
+func TestRunStepsSuccess(t *testing.T) {
+	r := &recorder{}
+	steps := []step{r.step("login", nil, nil), r.step("mount", nil, nil)}
+	if err := runSteps(testContext(), "Mount", steps); err != nil {
+		t.Fatalf("runSteps = %v, want nil", err)
+	}
+	want := []string{"do login", "do mount"}
+	if !reflect.DeepEqual(r.ran, want) {
+		t.Errorf("ran %v, want %v", r.ran, want)
+	}
+}
+
+func TestRunStepsRollback(t *testing.T) {
+	r := &recorder{}
+	failed := errors.New("mount failed")
+	undoFailed := errors.New("logout failed")
+	steps := []step{
+		r.step("register-acl", nil, nil),
+		r.step("login", nil, undoFailed),
+		{Name: "check-device", Do: func() error { return nil }},
+		r.step("mount", failed, nil),
+		r.step("mark-in-use", nil, nil),
+	}
+	err := runSteps(testContext(), "Mount", steps)
+	rerr, ok := err.(*RollbackError)
+	if !ok {
+		t.Fatalf("runSteps = %#v, want a *RollbackError", err)
+	}
+	want := []string{"do register-acl", "do login", "do mount", "undo login", "undo register-acl"}
+	if !reflect.DeepEqual(r.ran, want) {
+		t.Errorf("ran %v, want %v", r.ran, want)
+	}
+	if rerr.Op != "Mount" || rerr.Step != "mount" || rerr.Err != failed {
+		t.Errorf("RollbackError = %+v, want Mount failed at mount", rerr)
+	}
+	if !reflect.DeepEqual(rerr.Undone, []string{"register-acl"}) {
+		t.Errorf("Undone = %v, want [register-acl]", rerr.Undone)
+	}
+	if len(rerr.UndoFailed) != 1 || rerr.UndoFailed["login"] != undoFailed {
+		t.Errorf("UndoFailed = %v, want login: %s", rerr.UndoFailed, undoFailed)
+	}
+	msg := rerr.Error()
+	for _, s := range []string{"step 'mount'", "register-acl: ok", "login: logout failed"} {
+		if !strings.Contains(msg, s) {
+			t.Errorf("Error() = %q, want it to contain %q", msg, s)
+		}
+	}
+}
+
+func TestRollbackErrorNothingUndone(t *testing.T) {
+	err := &RollbackError{Op: "Create", Step: "create-volume", Err: errors.New("quota exceeded")}
+	want := "Create failed at step 'create-volume': quota exceeded"
+	if got := err.Error(); got != want {
+		t.Errorf("Error() = %q, want %q", got, want)
+	}
+}
+
+func TestRunStepsExpiredContext(t *testing.T) {
+	ctxt, cancel := context.WithTimeout(testContext(), 0)
+	defer cancel()
+	<-ctxt.Done()
+	var undoErr, undoDeadline error
+	var traceId interface{}
+	steps := []step{
+		{
+			Name: "login",
+			Do:   func() error { return nil },
+			Undo: func(uctxt context.Context) error {
+				undoErr = uctxt.Err()
+				traceId = uctxt.Value(co.TraceId)
+				if d, ok := uctxt.Deadline(); !ok || time.Until(d) <= 0 {
+					undoDeadline = errors.New("no deadline ahead")
+				}
+				return nil
+			},
+		},
+		{Name: "mount", Do: ctxt.Err},
+	}
+	err := runSteps(ctxt, "Mount", steps)
+	rerr, ok := err.(*RollbackError)
+	if !ok || !reflect.DeepEqual(rerr.Undone, []string{"login"}) {
+		t.Fatalf("runSteps = %#v, want login undone", err)
+	}
+	if undoErr != nil {
+		t.Errorf("undo context is done: %s", undoErr)
+	}
+	if undoDeadline != nil {
+		t.Errorf("undo context deadline: %s", undoDeadline)
+	}
+	if traceId != "test" {
+		t.Errorf("undo context trace id = %v, want test", traceId)
+	}
+}
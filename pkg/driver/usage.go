@@ -0,0 +1,204 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	co "github.com/Datera/docker-driver/pkg/common"
+
+	dc "github.com/Datera/datera-csi/pkg/client"
+)
+
+// Metadata keys recording the containers using a Docker volume on a host are
+// this prefix followed by "<host>:<volume>", holding a comma separated list
+// of container mount IDs.  They are kept on the Datera volume backing the
+// Docker volume, which for subPath volumes is their source
+const usersKeyPrefix = "users:"
+
+// VolumeUser is a host using a Docker volume and the mount IDs of the
+// containers using it there
+type VolumeUser struct {
+	Host     string
+	MountIds []string
+}
+
+func usersKey(hostname, name string) string {
+	return usersKeyPrefix + hostname + ":" + name
+}
+
+func splitIds(v string) []string {
+	if v == "" {
+		return []string{}
+	}
+	return strings.Split(v, ",")
+}
+
+// usersOf returns the hosts using a Docker volume according to the metadata
+// of its backing volume, sorted by host
+func usersOf(md dc.VolMetadata, name string) []VolumeUser {
+	users := []VolumeUser{}
+	for k, v := range md {
+		if !strings.HasPrefix(k, usersKeyPrefix) || v == "" {
+			continue
+		}
+		hv := strings.SplitN(strings.TrimPrefix(k, usersKeyPrefix), ":", 2)
+		if len(hv) != 2 || hv[1] != name {
+			continue
+		}
+		users = append(users, VolumeUser{Host: hv[0], MountIds: splitIds(v)})
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Host < users[j].Host })
+	return users
+}
+
+// backingVolume returns the Datera volume holding a Docker volume
+func (d *DateraDriver) backingVolume(ctxt context.Context, vol *dc.Volume, sv *subVolume) (*dc.Volume, error) {
+	if sv == nil {
+		return vol, nil
+	}
+	return d.getVolume(ctxt, sv.Source, false, true)
+}
+
+// updateUsers applies f to this host's mount IDs of a Docker volume and
+// writes them back, returning the updated IDs
+func (d *DateraDriver) updateUsers(ctxt context.Context, vol *dc.Volume, name string, f func([]string) []string) ([]string, error) {
+	md, err := getMetadata(vol)
+	if err != nil {
+		return nil, err
+	}
+	key := usersKey(host, name)
+	ids := f(splitIds(md[key]))
+	sort.Strings(ids)
+	v := strings.Join(ids, ",")
+	if v == md[key] {
+		return ids, nil
+	}
+	err = d.retry(ctxt, "SetMetadata", func() error {
+		_, err := vol.SetMetadata(&dc.VolMetadata{key: v})
+		return classify("SetMetadata", vol.Name, err)
+	})
+	return ids, err
+}
+
+// addUser records a container using a Docker volume on this host
+func (d *DateraDriver) addUser(ctxt context.Context, vol *dc.Volume, name, id string) error {
+	if id == "" {
+		return nil
+	}
+	_, err := d.updateUsers(ctxt, vol, name, func(ids []string) []string {
+		for _, i := range ids {
+			if i == id {
+				return ids
+			}
+		}
+		return append(ids, id)
+	})
+	return err
+}
+
+// removeUser drops a container from the users of a Docker volume on this
+// host and returns the number of containers still using it here
+func (d *DateraDriver) removeUser(ctxt context.Context, vol *dc.Volume, name, id string) (int, error) {
+	ids, err := d.updateUsers(ctxt, vol, name, func(ids []string) []string {
+		left := []string{}
+		for _, i := range ids {
+			if i != id {
+				left = append(left, i)
+			}
+		}
+		return left
+	})
+	if err != nil {
+		return 0, err
+	}
+	co.Debugf(ctxt, "Volume %s has %d users left on this host", name, len(ids))
+	return len(ids), nil
+}
+
+// WhoUses returns the hosts and containers using a Docker volume
+func (d *DateraDriver) WhoUses(name string) (_ []VolumeUser, err error) {
+	ctxt, cancel := d.initFunc("WhoUses")
+	defer cancel()
+	defer func() { err = timedOut(ctxt, name, err) }()
+	vol, sv, err := d.lookup(ctxt, name)
+	if err != nil {
+		return nil, err
+	}
+	if vol, err = d.backingVolume(ctxt, vol, sv); err != nil {
+		return nil, err
+	}
+	md, err := getMetadata(vol)
+	if err != nil {
+		return nil, err
+	}
+	return usersOf(md, name), nil
+}
+
+// inUse describes who is using a Docker volume: hosts with containers using
+// it, this host if a container or Mount has claimed its attach and, for
+// volumes that aren't subPath volumes, any other host in its ACL or logged
+// in to it.  vol is the backing volume
+func (d *DateraDriver) inUse(ctxt context.Context, vol *dc.Volume, name string, sv *subVolume) ([]string, error) {
+	md, err := getMetadata(vol)
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	users := []string{}
+	add := func(u string) {
+		if !seen[u] {
+			seen[u] = true
+			users = append(users, u)
+		}
+	}
+	for _, u := range usersOf(md, name) {
+		add(u.Host)
+	}
+	if op, ok := d.attaches[name]; ok && op.claimed() {
+		add(host)
+	}
+	if sv != nil {
+		return users, nil
+	}
+	init, err := d.getInitiator(ctxt)
+	if err != nil {
+		return nil, err
+	}
+	others, err := d.remoteInitiators(ctxt, vol, init)
+	if err != nil {
+		return nil, err
+	}
+	leases := leasesOf(ctxt, md)
+	for _, iqn := range others {
+		if l, ok := leases[iqn]; ok {
+			add(l.Host)
+		} else {
+			add(iqn)
+		}
+	}
+	return users, nil
+}
+
+// checkIdle refuses to remove a Docker volume that is in use unless the
+// driver is configured to force removal.  d.Mutex must be held
+func (d *DateraDriver) checkIdle(ctxt context.Context, vol *dc.Volume, name string, sv *subVolume) error {
+	users, err := d.inUse(ctxt, vol, name, sv)
+	if err != nil {
+		return err
+	}
+	if len(users) == 0 {
+		return nil
+	}
+	if d.Config.ForceRemove {
+		co.Warningf(ctxt, "Removing volume %s in use by [%s]", name, strings.Join(users, ", "))
+		return nil
+	}
+	return &BackendError{
+		Kind: ErrConflict,
+		Op:   "Remove",
+		Name: name,
+		Err:  fmt.Errorf("volume is in use by [%s]", strings.Join(users, ", ")),
+	}
+}